@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -8,18 +9,31 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/roerd/httpfromtcp/internal/request"
 	"github.com/roerd/httpfromtcp/internal/response"
 	"github.com/roerd/httpfromtcp/internal/server"
+	"github.com/roerd/httpfromtcp/internal/sse"
+	"github.com/roerd/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
 
 func main() {
-	server, err := server.Serve(port, handler)
+	router := server.NewRouter()
+	router.Handle(request.MethodGet, "/", handleRoot)
+	router.Handle(request.MethodGet, "/yourproblem", handleYourProblem)
+	router.Handle(request.MethodGet, "/myproblem", handleMyProblem)
+	router.Handle(request.MethodGet, "/httpbin/", handleHttpbin)
+	router.Handle(request.MethodGet, "/video", handleVideo)
+	router.Handle(request.MethodGet, "/echo", handleEcho)
+	router.Handle(request.MethodGet, "/clock", handleClock)
+
+	server, err := server.Serve(port, server.Compress(router.Dispatch))
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -32,13 +46,12 @@ func main() {
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) {
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		err := w.WriteStatusLine(400)
-		if err != nil {
-			log.Panicf("Error writing status line: %v", err)
-		}
-		body := []byte(`<html>
+func handleYourProblem(w *response.Writer, req *request.Request) {
+	err := w.WriteStatusLine(400)
+	if err != nil {
+		log.Panicf("Error writing status line: %v", err)
+	}
+	body := []byte(`<html>
   <head>
     <title>400 Bad Request</title>
   </head>
@@ -47,24 +60,19 @@ func handler(w *response.Writer, req *request.Request) {
     <p>Your request honestly kinda sucked.</p>
   </body>
 </html>`)
-		headers := response.GetDefaultHeaders(len(body), "text/html")
-		err = w.WriteHeaders(headers)
-		if err != nil {
-			log.Panicf("Error writing headers: %v", err)
-		}
-		_, err = w.WriteBody(body)
-		if err != nil {
-			log.Panicf("Error writing body: %v", err)
-		}
-		return
+	w.Header().Set("Content-Type", "text/html")
+	_, err = w.Write(body)
+	if err != nil {
+		log.Panicf("Error writing body: %v", err)
 	}
+}
 
-	if req.RequestLine.RequestTarget == "/myproblem" {
-		err := w.WriteStatusLine(500)
-		if err != nil {
-			log.Panicf("Error writing status line: %v", err)
-		}
-		body := []byte(`<html>
+func handleMyProblem(w *response.Writer, req *request.Request) {
+	err := w.WriteStatusLine(500)
+	if err != nil {
+		log.Panicf("Error writing status line: %v", err)
+	}
+	body := []byte(`<html>
   <head>
     <title>500 Internal Server Error</title>
   </head>
@@ -73,90 +81,152 @@ func handler(w *response.Writer, req *request.Request) {
     <p>Okay, you know what? This one is on me.</p>
   </body>
 </html>`)
-		headers := response.GetDefaultHeaders(len(body), "text/html")
-		err = w.WriteHeaders(headers)
-		if err != nil {
-			log.Panicf("Error writing headers: %v", err)
-		}
-		_, err = w.WriteBody(body)
-		if err != nil {
-			log.Panicf("Error writing body: %v", err)
+	w.Header().Set("Content-Type", "text/html")
+	_, err = w.Write(body)
+	if err != nil {
+		log.Panicf("Error writing body: %v", err)
+	}
+}
+
+func handleHttpbin(w *response.Writer, req *request.Request) {
+	path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
+	// stop fetching from upstream as soon as our client is gone
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, "https://httpbin.org/"+path, nil)
+	if err != nil {
+		log.Panicf("Error creating HTTP request: %v", err)
+	}
+	// make the request before committing to a status, so that the client
+	// learns about upstream failures
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		log.Printf("Error making HTTP request: %v (%v)", err, context.Cause(req.Context()))
+		herr := &server.HandlerError{
+			StatusCode: 502,
+			Detail:     "httpbin.org could not be reached",
 		}
+		herr.WriteResponse(w, req)
 		return
 	}
+	defer resp.Body.Close()
 
-	if path, ok := strings.CutPrefix(req.RequestLine.RequestTarget, "/httpbin/"); ok {
-		err := w.WriteStatusLine(200)
-		if err != nil {
-			log.Panicf("Error writing status line: %v", err)
-		}
-		headers := response.GetDefaultHeaders(0, "application/json")
-		headers.Delete("Content-Length")
-		headers.Set("Transfer-Encoding", "chunked")
-		headers.Set("Trailers", "X-Content-SHA256,X-Content-Length")
-		err = w.WriteHeaders(headers)
-		if err != nil {
-			log.Panicf("Error writing headers: %v", err)
-		}
-		resp, err := http.Get("https://httpbin.org/" + path)
-		if err != nil {
-			log.Panicf("Error making HTTP request: %v", err)
-		}
-		defer resp.Body.Close()
+	err = w.WriteStatusLine(200)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+	headers := response.GetDefaultHeaders(0, "application/json")
+	headers.Delete("Content-Length")
+	headers.Set("Transfer-Encoding", "chunked")
+	headers.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+	err = w.WriteHeaders(headers)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
 
-		buf := make([]byte, 1024)
-		fullBody := make([]byte, 0)
-		for {
-			n, err := resp.Body.Read(buf)
-			if err != nil && err != io.EOF {
-				log.Panicf("Error reading response body: %v", err)
-			}
-			log.Printf("received %d bytes\n", n)
-			if n == 0 {
-				break
-			}
-			fullBody = append(fullBody, buf[:n]...)
-			_, err = w.WriteChunkedBody(buf[:n])
-			if err != nil {
-				log.Panicf("Error writing chunk: %v", err)
-			}
-		}
-		_, err = w.WriteChunkedBodyDone()
+	buf := make([]byte, 1024)
+	fullBody := make([]byte, 0)
+	for {
+		n, err := resp.Body.Read(buf)
+		if err != nil && err != io.EOF {
+			log.Printf("Error reading response body: %v (%v)", err, context.Cause(req.Context()))
+			return
+		}
+		log.Printf("received %d bytes\n", n)
+		if n == 0 {
+			break
+		}
+		fullBody = append(fullBody, buf[:n]...)
+		_, err = w.WriteChunkedBody(buf[:n])
 		if err != nil {
-			log.Panicf("Error writing chunk: %v", err)
+			// most likely the client went away before the context was
+			// cancelled, which is no reason to take the server down
+			log.Printf("Error writing chunk: %v", err)
+			return
 		}
-		hash := sha256.Sum256(fullBody)
-		trailers := response.GetNewHeaders()
-		trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash))
-		trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-		err = w.WriteTrailers(trailers)
+		err = w.Flush()
 		if err != nil {
-			log.Panicf("Error writing trailers: %v", err)
+			log.Printf("Error flushing chunk: %v", err)
+			return
 		}
+	}
+	_, err = w.WriteChunkedBodyDone()
+	if err != nil {
+		log.Printf("Error writing chunk: %v", err)
 		return
 	}
+	hash := sha256.Sum256(fullBody)
+	trailers := response.GetNewHeaders()
+	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash))
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
+	err = w.WriteTrailers(trailers)
+	if err != nil {
+		log.Printf("Error writing trailers: %v", err)
+	}
+}
 
-	if req.RequestLine.RequestTarget == "/video" {
-		err := w.WriteStatusLine(200)
-		if err != nil {
-			log.Panicf("Error writing status line: %v", err)
-		}
-		body, err := os.ReadFile("assets/vim.mp4")
+func handleVideo(w *response.Writer, req *request.Request) {
+	err := w.WriteStatusLine(200)
+	if err != nil {
+		log.Panicf("Error writing status line: %v", err)
+	}
+	file, err := os.Open("assets/vim.mp4")
+	if err != nil {
+		log.Panicf("Error opening file: %v", err)
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "video/mp4")
+	_, err = w.ReadFrom(file)
+	if err != nil {
+		log.Panicf("Error writing body: %v", err)
+	}
+}
+
+func handleEcho(w *response.Writer, req *request.Request) {
+	conn, err := websocket.Upgrade(w, req, websocket.WithCompression())
+	if err != nil {
+		log.Printf("Error upgrading to websocket: %v", err)
+		return
+	}
+	defer conn.CloseNow()
+	for {
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Panicf("Error reading file: %v", err)
+			log.Printf("Websocket closed: %v", err)
+			return
 		}
-		headers := response.GetDefaultHeaders(len(body), "video/mp4")
-		err = w.WriteHeaders(headers)
+		err = conn.WriteMessage(messageType, data)
 		if err != nil {
-			log.Panicf("Error writing headers: %v", err)
+			log.Printf("Error writing websocket message: %v", err)
+			return
 		}
-		_, err = w.WriteBody(body)
-		if err != nil {
-			log.Panicf("Error writing body: %v", err)
+	}
+}
+
+func handleClock(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req)
+	if err != nil {
+		log.Panicf("Error starting event stream: %v", err)
+	}
+	defer stream.Close()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			err = stream.Send(sse.Event{Event: "tick", ID: strconv.FormatInt(now.Unix(), 10), Data: now.Format(time.RFC3339)})
+			if err != nil {
+				log.Printf("Event stream ended: %v", err)
+				return
+			}
+		case <-stream.Done():
+			log.Printf("Event stream ended: %v", context.Cause(req.Context()))
+			return
 		}
-		return
 	}
+}
 
+func handleRoot(w *response.Writer, req *request.Request) {
 	err := w.WriteStatusLine(200)
 	if err != nil {
 		log.Panicf("Error writing status line: %v", err)
@@ -170,12 +240,8 @@ func handler(w *response.Writer, req *request.Request) {
     <p>Your request was an absolute banger.</p>
   </body>
 </html>`)
-	headers := response.GetDefaultHeaders(len(body), "text/html")
-	err = w.WriteHeaders(headers)
-	if err != nil {
-		log.Panicf("Error writing headers: %v", err)
-	}
-	_, err = w.WriteBody(body)
+	w.Header().Set("Content-Type", "text/html")
+	_, err = w.Write(body)
 	if err != nil {
 		log.Panicf("Error writing body: %v", err)
 	}
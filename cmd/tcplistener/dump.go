@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// escapedDump writes data line by line with Go escapes, so that CRLFs,
+// control characters and invalid UTF-8 are visible. Each line starts with
+// its offset. If mark is a position in data (or just past it), a caret
+// points at it.
+func escapedDump(w io.Writer, data []byte, mark int) {
+	for start := 0; start < len(data); {
+		end := len(data)
+		if i := bytes.IndexByte(data[start:], '\n'); i >= 0 {
+			end = start + i + 1
+		}
+		fmt.Fprintf(w, "%8d  %s\n", start, escape(data[start:end]))
+		if mark >= start && (mark < end || mark == len(data) && end == len(data)) {
+			fmt.Fprintf(w, "%s^\n", strings.Repeat(" ", 10+len(escape(data[start:mark]))))
+		}
+		start = end
+	}
+}
+
+func escape(b []byte) string {
+	quoted := strconv.Quote(string(b))
+	return quoted[1 : len(quoted)-1]
+}
+
+// hexDump writes data like hexdump -C, with a caret under the byte at mark
+// if it is a position in data (or just past it).
+func hexDump(w io.Writer, data []byte, mark int) {
+	const width = 16
+	for start := 0; start < len(data); start += width {
+		row := data[start:min(start+width, len(data))]
+		var line strings.Builder
+		fmt.Fprintf(&line, "%08x  ", start)
+		for i := range width {
+			if i < len(row) {
+				fmt.Fprintf(&line, "%02x ", row[i])
+			} else {
+				line.WriteString("   ")
+			}
+			if i == width/2-1 {
+				line.WriteByte(' ')
+			}
+		}
+		line.WriteString(" |")
+		for _, c := range row {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			line.WriteByte(c)
+		}
+		line.WriteString("|\n")
+		io.WriteString(w, line.String())
+
+		if mark >= start && (mark < start+len(row) || mark == len(data) && start+len(row) == len(data)) {
+			column := 10 + 3*(mark-start)
+			if mark-start >= width/2 {
+				column++
+			}
+			fmt.Fprintf(w, "%s^^\n", strings.Repeat(" ", column))
+		}
+	}
+}
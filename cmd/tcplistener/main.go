@@ -1,45 +1,234 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/roerd/httpfromtcp/internal/request"
 )
 
 func main() {
-	listener, err := net.Listen("tcp", ":42069")
+	addr := flag.String("addr", ":42069", "address to listen on")
+	jsonOutput := flag.Bool("json", false, "print one JSON object per connection instead of text")
+	dump := flag.String("dump", "escaped", "how to show the bytes received: escaped, hex or none")
+	timeout := flag.Duration("timeout", 30*time.Second, "time a client has to send its request")
+	flag.Parse()
+	if *dump != "escaped" && *dump != "hex" && *dump != "none" {
+		log.Fatalf("invalid -dump %q, must be escaped, hex or none", *dump)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer listener.Close()
+	log.Println("Listening on", listener.Addr())
 
+	in := &inspector{
+		out:        os.Stdout,
+		jsonOutput: *jsonOutput,
+		dump:       *dump,
+		timeout:    *timeout,
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Error accepting connection:", err)
+			continue
 		}
-		fmt.Println("Connection accepted")
-		request, err := request.RequestFromReader(conn)
-		if err != nil {
-			log.Fatal(err)
+		go in.handle(conn)
+	}
+}
+
+// inspector reads one request from each connection and prints what it
+// received, how it was parsed and how long that took. Reports of concurrent
+// connections are printed one after the other.
+type inspector struct {
+	mu         sync.Mutex
+	out        io.Writer
+	jsonOutput bool
+	dump       string
+	timeout    time.Duration
+}
+
+// report is what the inspector prints for a connection.
+type report struct {
+	Remote  string       `json:"remote"`
+	Request *requestInfo `json:"request,omitempty"`
+	Error   *errorInfo   `json:"error,omitempty"`
+	Timing  timing       `json:"timing"`
+	// Raw holds the bytes received as a string; RawHex holds them
+	// hex-encoded with -dump=hex.
+	Raw    string `json:"raw,omitempty"`
+	RawHex string `json:"raw_hex,omitempty"`
+
+	raw []byte
+}
+
+type requestInfo struct {
+	Method  string            `json:"method"`
+	Target  string            `json:"target"`
+	Version string            `json:"version"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+type errorInfo struct {
+	Message string `json:"message"`
+	// Offset is the position in the raw bytes where the parser found the
+	// problem, if it was a parse error.
+	Offset *int `json:"offset,omitempty"`
+}
+
+// timing holds the time from accepting the connection to the end of each
+// phase, in milliseconds. Phases that were not reached are zero.
+type timing struct {
+	FirstByte float64 `json:"first_byte_ms"`
+	Headers   float64 `json:"headers_ms"`
+	Body      float64 `json:"body_ms"`
+}
+
+// recorder keeps a copy of everything read from a connection and notes
+// when the first byte arrived.
+type recorder struct {
+	conn      net.Conn
+	data      []byte
+	firstByte time.Time
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 && r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+	r.data = append(r.data, p[:n]...)
+	return n, err
+}
+
+func (in *inspector) handle(conn net.Conn) {
+	defer conn.Close()
+	r := in.inspect(conn)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var err error
+	if in.jsonOutput {
+		err = json.NewEncoder(in.out).Encode(r)
+	} else {
+		err = in.printText(r)
+	}
+	if err != nil {
+		log.Printf("error printing report for %s: %v\n", r.Remote, err)
+	}
+}
+
+func (in *inspector) inspect(conn net.Conn) *report {
+	start := time.Now()
+	since := func(t time.Time) float64 {
+		return float64(t.Sub(start).Microseconds()) / 1000
+	}
+	conn.SetReadDeadline(start.Add(in.timeout))
+	rec := &recorder{conn: conn}
+	r := &report{Remote: conn.RemoteAddr().String()}
+
+	req, err := request.ReadHeaders(rec)
+	if err == nil {
+		r.Timing.Headers = since(time.Now())
+		err = req.ReadBody()
+		if err == nil {
+			r.Timing.Body = since(time.Now())
+		}
+	}
+	if !rec.firstByte.IsZero() {
+		r.Timing.FirstByte = since(rec.firstByte)
+	}
+
+	if req != nil {
+		r.Request = &requestInfo{
+			Method:  req.RequestLine.Method,
+			Target:  req.RequestLine.RequestTarget,
+			Version: req.RequestLine.HttpVersion,
+			Headers: req.Headers,
+			Body:    string(req.Body),
+		}
+	}
+	if err != nil {
+		r.Error = &errorInfo{Message: err.Error()}
+		var pErr *request.ParseError
+		if errors.As(err, &pErr) {
+			r.Error.Offset = &pErr.Offset
 		}
+	}
+
+	r.raw = rec.data
+	switch in.dump {
+	case "escaped":
+		r.Raw = string(rec.data)
+	case "hex":
+		r.RawHex = fmt.Sprintf("%x", rec.data)
+	}
+	return r
+}
+
+func (in *inspector) printText(r *report) error {
+	var b strings.Builder
+	fmt.Fprintln(&b, "Connection accepted from", r.Remote)
+	if r.Request != nil {
+		fmt.Fprintln(&b, "Request line:")
+		fmt.Fprintln(&b, "- Method:", r.Request.Method)
+		fmt.Fprintln(&b, "- Target:", r.Request.Target)
+		fmt.Fprintln(&b, "- Version:", r.Request.Version)
 
-		requestLine := request.RequestLine
-		fmt.Println("Request line:")
-		fmt.Println("- Method:", requestLine.Method)
-		fmt.Println("- Target:", requestLine.RequestTarget)
-		fmt.Println("- Version:", requestLine.HttpVersion)
+		fmt.Fprintln(&b, "Headers:")
+		keys := make([]string, 0, len(r.Request.Headers))
+		for key := range r.Request.Headers {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "- %s: %s\n", key, r.Request.Headers[key])
+		}
 
-		fmt.Println("Headers:")
-		for key, value := range request.Headers {
-			fmt.Printf("- %s: %s\n", key, value)
+		if r.Error == nil {
+			fmt.Fprintln(&b, "Body:")
+			fmt.Fprintln(&b, r.Request.Body)
 		}
+	}
 
-		fmt.Println("Body:")
-		fmt.Println(string(request.Body))
+	fmt.Fprintln(&b, "Timing:")
+	fmt.Fprintf(&b, "- First byte: %.3fms\n", r.Timing.FirstByte)
+	fmt.Fprintf(&b, "- Headers: %.3fms\n", r.Timing.Headers)
+	fmt.Fprintf(&b, "- Body: %.3fms\n", r.Timing.Body)
+
+	mark := -1
+	if r.Error != nil && r.Error.Offset != nil {
+		mark = *r.Error.Offset
+	}
+	switch in.dump {
+	case "escaped":
+		fmt.Fprintf(&b, "Raw (%d bytes):\n", len(r.raw))
+		escapedDump(&b, r.raw, mark)
+	case "hex":
+		fmt.Fprintf(&b, "Raw (%d bytes):\n", len(r.raw))
+		hexDump(&b, r.raw, mark)
+	}
 
-		fmt.Println("Connection closed")
+	if r.Error != nil {
+		fmt.Fprintln(&b, "Error:", r.Error.Message)
 	}
+	fmt.Fprintln(&b, "Connection closed")
+	_, err := io.WriteString(in.out, b.String())
+	return err
 }
@@ -0,0 +1,190 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+)
+
+var ErrInvalidCookie = errors.New("invalid cookie")
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+// Cookie is a cookie as sent by a client in the Cookie header, of which only
+// Name and Value are set, or as set by a server with Set-Cookie (RFC 6265,
+// section 4.1).
+type Cookie struct {
+	Name  string
+	Value string
+
+	Domain  string
+	Path    string
+	Expires time.Time
+	// MaxAge is the lifetime in seconds. Zero leaves the attribute out, a
+	// negative value deletes the cookie right away (Max-Age=0).
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned keeps the cookie in storage partitioned by the top-level
+	// site (CHIPS). It requires Secure.
+	Partitioned bool
+}
+
+// Parse parses the value of a Cookie header into its name=value pairs, in
+// the order they were sent. Pairs that are not well-formed are skipped.
+// Commas separate pairs as well, since repeated Cookie headers arrive joined
+// with ", " and a comma cannot be part of a cookie value.
+func Parse(header string) []*Cookie {
+	var cookies []*Cookie
+	separators := func(r rune) bool { return r == ';' || r == ',' }
+	for _, pair := range strings.FieldsFunc(header, separators) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !headers.IsToken([]byte(name)) {
+			continue
+		}
+		value, ok = parseValue(value)
+		if !ok {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// parseValue strips the optional double quotes around a cookie value and
+// checks that only cookie-octets remain.
+func parseValue(value string) (string, bool) {
+	if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// isCookieOctet reports whether c may appear in a cookie value: visible
+// US-ASCII except the double quote, comma, semicolon and backslash.
+func isCookieOctet(c byte) bool {
+	return 0x20 < c && c < 0x7f && c != '"' && c != ',' && c != ';' && c != '\\'
+}
+
+// Valid reports whether the cookie can be sent in a Set-Cookie header.
+func (c *Cookie) Valid() error {
+	if !headers.IsToken([]byte(c.Name)) {
+		return fmt.Errorf("%w: name %q", ErrInvalidCookie, c.Name)
+	}
+	for i := 0; i < len(c.Value); i++ {
+		// spaces and commas are sent quoted
+		if b := c.Value[i]; !isCookieOctet(b) && b != ' ' && b != ',' {
+			return fmt.Errorf("%w: value %q", ErrInvalidCookie, c.Value)
+		}
+	}
+	for i := 0; i < len(c.Path); i++ {
+		if b := c.Path[i]; b < 0x20 || b == 0x7f || b == ';' {
+			return fmt.Errorf("%w: path %q", ErrInvalidCookie, c.Path)
+		}
+	}
+	if c.Domain != "" && !validDomain(strings.TrimPrefix(c.Domain, ".")) {
+		return fmt.Errorf("%w: domain %q", ErrInvalidCookie, c.Domain)
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return fmt.Errorf("%w: SameSite=None requires Secure", ErrInvalidCookie)
+	}
+	if c.Partitioned && !c.Secure {
+		return fmt.Errorf("%w: Partitioned requires Secure", ErrInvalidCookie)
+	}
+	return nil
+}
+
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+	for label := range strings.SplitSeq(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String returns the value of a Set-Cookie header for the cookie. It does
+// not validate the cookie; see Valid.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	if strings.ContainsAny(c.Value, " ,") {
+		b.WriteString(`"` + c.Value + `"`)
+	} else {
+		b.WriteString(c.Value)
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=" + c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// TimeFormat is the IMF-fixdate format used for Expires (RFC 9110, section
+// 5.6.7).
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
@@ -0,0 +1,77 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Several pairs
+	cookies := Parse(`session=abc123; theme="dark"; lang=en`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "lang", cookies[2].Name)
+
+	// Test: Repeated Cookie headers joined by the header parser
+	cookies = Parse("a=1, b=2; c=3")
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "b", cookies[1].Name)
+
+	// Test: Malformed pairs are skipped
+	cookies = Parse(`noequals; bad name=1; ok=; quoted="a"b"; ok2=2`)
+	require.Len(t, cookies, 2)
+	assert.Equal(t, "ok", cookies[0].Name)
+	assert.Equal(t, "", cookies[0].Value)
+	assert.Equal(t, "ok2", cookies[1].Name)
+
+	// Test: Empty header
+	assert.Empty(t, Parse(""))
+}
+
+func TestCookieString(t *testing.T) {
+	// Test: All attributes
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Domain:      ".example.com",
+		Path:        "/",
+		Expires:     time.Date(2030, time.January, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Wed, 02 Jan 2030 02:04:05 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=None; Partitioned", c.String())
+
+	// Test: Value with spaces is quoted
+	c = &Cookie{Name: "greeting", Value: "hello world"}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, `greeting="hello world"`, c.String())
+
+	// Test: Negative MaxAge deletes the cookie
+	c = &Cookie{Name: "session", MaxAge: -1, SameSite: SameSiteLax}
+	assert.Equal(t, "session=; Max-Age=0; SameSite=Lax", c.String())
+}
+
+func TestCookieValid(t *testing.T) {
+	for _, c := range []*Cookie{
+		{Name: ""},
+		{Name: "a b", Value: "1"},
+		{Name: "a", Value: "semi;colon"},
+		{Name: "a", Value: `back\slash`},
+		{Name: "a", Path: "/x;y"},
+		{Name: "a", Domain: "exa mple.com"},
+		{Name: "a", Domain: "-example.com"},
+		{Name: "a", SameSite: SameSiteNone},
+		{Name: "a", Partitioned: true},
+	} {
+		assert.ErrorIs(t, c.Valid(), ErrInvalidCookie, "cookie %+v", c)
+	}
+}
@@ -1,8 +1,8 @@
 package headers
 
 import (
+	"bytes"
 	"fmt"
-	"regexp"
 	"strings"
 )
 
@@ -12,34 +12,102 @@ func NewHeaders() Headers {
 	return make(Headers)
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	lines := strings.Split(string(data), "\r\n")
+// tokenChars marks the characters allowed in a token (RFC 9110, section
+// 5.6.2), such as a field name or a method.
+var tokenChars = func() (table [256]bool) {
+	for c := 'a'; c <= 'z'; c++ {
+		table[c] = true
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		table[c] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		table[c] = true
+	}
+	for _, c := range []byte("!#$%&'*+-.^_`|~") {
+		table[c] = true
+	}
+	return table
+}()
 
-	if len(lines) < 2 {
-		return 0, false, nil
+// IsToken reports whether b is a non-empty token as defined in RFC 9110,
+// section 5.6.2.
+func IsToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !tokenChars[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// commonKeys interns the lowercased names of frequently sent headers, so
+// parsing them does not allocate a new string each time.
+var commonKeys = func() map[string]string {
+	keys := make(map[string]string)
+	for _, key := range []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-encoding", "content-length",
+		"content-type", "cookie", "expect", "host", "if-modified-since",
+		"if-none-match", "origin", "range", "referer", "transfer-encoding",
+		"upgrade", "user-agent",
+	} {
+		keys[key] = key
 	}
+	return keys
+}()
 
-	line := lines[0]
+const maxStackKey = 64
 
-	if line == "" {
+func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return 0, false, nil
+	}
+	if end == 0 {
 		return len("\r\n"), true, nil
 	}
+	line := data[:end]
 
-	key, value, found := strings.Cut(line, ":")
-	if !found {
+	colon := bytes.IndexByte(line, ':')
+	if colon < 0 {
 		return 0, false, fmt.Errorf("invalid header line: %q", line)
 	}
-	key = strings.TrimLeft(key, " \t")
-	if matched, _ := regexp.MatchString("^[a-zA-Z0-9!#$%&'*+.^_`|~-]+$", key); !matched {
+	key := bytes.TrimLeft(line[:colon], " \t")
+	if !IsToken(key) {
 		return 0, false, fmt.Errorf("invalid header key: %q", key)
 	}
-	key = strings.ToLower(key)
-	value = strings.TrimSpace(value)
-	if existing, ok := h[key]; ok {
+	value := string(bytes.TrimSpace(line[colon+1:]))
+
+	lowerKey := lower(key)
+	if existing, ok := h[lowerKey]; ok {
 		value = existing + ", " + value
 	}
-	h[key] = value
-	return len(line) + len("\r\n"), false, nil
+	h[lowerKey] = value
+	return end + len("\r\n"), false, nil
+}
+
+// lower returns the lowercased key as a string, without allocating for
+// common header names.
+func lower(key []byte) string {
+	if len(key) > maxStackKey {
+		return strings.ToLower(string(key))
+	}
+	var buf [maxStackKey]byte
+	lowered := buf[:len(key)]
+	for i, c := range key {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lowered[i] = c
+	}
+	if common, ok := commonKeys[string(lowered)]; ok {
+		return common
+	}
+	return string(lowered)
 }
 
 func (h Headers) Get(key string) string {
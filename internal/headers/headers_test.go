@@ -88,3 +88,15 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, len("Set-Person: tj-loves-ocaml\r\n"), n)
 	assert.False(t, done)
 }
+
+func BenchmarkParse(b *testing.B) {
+	data := []byte("User-Agent: curl/7.81.0\r\n")
+	b.ReportAllocs()
+	for b.Loop() {
+		headers := NewHeaders()
+		_, _, err := headers.Parse(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package request
+
+import "context"
+
+// Context returns the request's context. For requests served by the server
+// it is cancelled when the client goes away, when the server is closed or
+// when the handler runs out of time, and context.Cause tells which. It is
+// context.Background() for requests that were not given a context.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of the request with its context
+// replaced by ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
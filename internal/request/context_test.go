@@ -0,0 +1,25 @@
+package request
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext(t *testing.T) {
+	// Test: Background by default
+	r, err := RequestFromReader(strings.NewReader("GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext returns a copy
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, "value", r2.Context().Value(key{}))
+	assert.Equal(t, "/coffee", r2.Path())
+	assert.Equal(t, context.Background(), r.Context())
+}
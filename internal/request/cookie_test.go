@@ -0,0 +1,29 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookies(t *testing.T) {
+	// Test: Cookies from repeated headers
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Cookie: session=abc123; theme=dark\r\n" +
+		"Cookie: lang=en\r\n" +
+		"\r\n"))
+	require.NoError(t, err)
+	cookies := r.Cookies()
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "lang", cookies[2].Name)
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", c.Value)
+
+	// Test: Missing cookie
+	_, err = r.Cookie("missing")
+	assert.ErrorIs(t, err, ErrNoCookie)
+}
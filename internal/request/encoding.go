@@ -0,0 +1,87 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupportedContentEncoding = errors.New("unsupported content encoding")
+
+// DecodeBody undoes the content codings listed in the Content-Encoding
+// header (gzip, deflate, or several of them stacked), replacing Body with
+// the decoded bytes and updating the headers to match. Decoding stops with
+// ErrBodyTooLarge once the body grows beyond maxSize bytes, so that a small
+// compressed upload cannot exhaust memory. Unknown codings yield an error
+// wrapping ErrUnsupportedContentEncoding.
+func (r *Request) DecodeBody(maxSize int) error {
+	contentEncoding := r.Headers.Get("Content-Encoding")
+	if contentEncoding == "" {
+		return nil
+	}
+	err := r.ReadBody()
+	if err != nil {
+		return err
+	}
+
+	codings := strings.Split(contentEncoding, ",")
+	body := r.Body
+	// codings are listed in the order they were applied, so undo them
+	// back to front
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		decoded, err := decode(coding, body, maxSize)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	}
+
+	r.Body = body
+	r.Headers.Delete("Content-Encoding")
+	r.ContentLength = len(body)
+	r.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func decode(coding string, body []byte, maxSize int) ([]byte, error) {
+	var reader io.Reader
+	switch coding {
+	case "identity", "":
+		return body, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			// some clients send a raw deflate stream instead of the zlib
+			// format the content coding calls for
+			reader = flate.NewReader(bytes.NewReader(body))
+			break
+		}
+		defer zlibReader.Close()
+		reader = zlibReader
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedContentEncoding, coding)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %v", coding, err)
+	}
+	if len(decoded) > maxSize {
+		return nil, fmt.Errorf("%w: decoded body exceeds %d bytes", ErrBodyTooLarge, maxSize)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,84 @@
+package request
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func deflated(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func requestWithBody(t *testing.T, contentEncoding string, body []byte) *Request {
+	t.Helper()
+	r, err := RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Encoding: " + contentEncoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		string(body)))
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	json := []byte(`{"coffee":"black","cups":2}`)
+
+	// Test: gzip
+	r := requestWithBody(t, "gzip", gzipped(t, json))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, json, r.Body)
+	assert.Equal(t, "", r.Headers.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(json)), r.Headers.Get("Content-Length"))
+
+	// Test: deflate
+	r = requestWithBody(t, "deflate", deflated(t, json))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, json, r.Body)
+
+	// Test: Stacked codings are undone in reverse order
+	r = requestWithBody(t, "gzip, deflate", deflated(t, gzipped(t, json)))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, json, r.Body)
+
+	// Test: Decompressed size limit
+	bomb := gzipped(t, bytes.Repeat([]byte{0}, 1<<20))
+	r = requestWithBody(t, "gzip", bomb)
+	err := r.DecodeBody(1024)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Unknown coding
+	r = requestWithBody(t, "br", json)
+	err = r.DecodeBody(1024)
+	require.ErrorIs(t, err, ErrUnsupportedContentEncoding)
+
+	// Test: Corrupt body
+	r = requestWithBody(t, "gzip", json)
+	err = r.DecodeBody(1024)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnsupportedContentEncoding)
+}
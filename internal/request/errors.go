@@ -0,0 +1,47 @@
+package request
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrMalformedHeader      = errors.New("malformed header")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP version")
+	ErrHeaderTooLarge       = errors.New("request header too large")
+	ErrInvalidContentLength = errors.New("invalid Content-Length")
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrTimeout              = errors.New("timeout reading request")
+	ErrIncompleteRequest    = errors.New("connection closed before the request was complete")
+)
+
+// ParseError is returned by ReadHeaders, ReadBody and RequestFromReader for
+// requests that cannot be parsed. Err is one of the errors above, so callers
+// can check for them with errors.Is. The reason only describes the request
+// itself and is safe to send back to the client.
+type ParseError struct {
+	Err    error
+	Reason string
+	// Offset is the position in the request at which the problem was found,
+	// in bytes: the start of the offending line for the request line and
+	// headers, and the number of bytes read for the body.
+	Offset int
+}
+
+func (e *ParseError) Error() string {
+	msg := e.Err.Error()
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg + " (at byte " + strconv.Itoa(e.Offset) + ")"
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseError creates a ParseError whose offset is filled in by read.
+func parseError(err error, reason string) *ParseError {
+	return &ParseError{Err: err, Reason: reason}
+}
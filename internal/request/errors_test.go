@@ -0,0 +1,68 @@
+package request
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request string
+		opts    []Option
+		err     error
+		offset  int
+	}{
+		{"Malformed request line", "GET /\r\nHost: localhost\r\n\r\n", nil, ErrMalformedRequestLine, 0},
+		{"Malformed version", "GET / HTTP/one\r\nHost: localhost\r\n\r\n", nil, ErrMalformedRequestLine, 0},
+		{"Unsupported version", "GET / HTTP/2.0\r\nHost: localhost\r\n\r\n", nil, ErrUnsupportedVersion, 0},
+		{"Malformed header", "GET / HTTP/1.1\r\nHost: localhost\r\nBad Header: x\r\n\r\n", nil, ErrMalformedHeader, 33},
+		{"Missing Host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", nil, ErrMalformedHeader, 29},
+		{"Header too large", "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 100) + "\r\n\r\n", []Option{WithMaxHeaderBytes(64)}, ErrHeaderTooLarge, 33},
+		{"Body too large", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n", []Option{WithMaxBodyBytes(10)}, ErrBodyTooLarge, 57},
+		{"Invalid Content-Length", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: -1\r\n\r\n", nil, ErrInvalidContentLength, 56},
+		{"Conflicting Content-Length", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", nil, ErrInvalidContentLength, 74},
+		{"EOF before complete", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nab", nil, ErrIncompleteRequest, 57},
+	} {
+		_, err := RequestFromReader(strings.NewReader(tc.request), tc.opts...)
+		require.ErrorIs(t, err, tc.err, tc.name)
+		var pErr *ParseError
+		require.ErrorAs(t, err, &pErr, tc.name)
+		assert.Equal(t, tc.offset, pErr.Offset, tc.name)
+	}
+
+	// Test: Repeated identical Content-Length
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nab"))
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(r.Body))
+
+	// Test: Timeout
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.WriteString(client, "GET / HTTP/1.1\r\n")
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = RequestFromReader(server)
+	require.ErrorIs(t, err, ErrTimeout)
+
+	// Test: Other read errors are passed through
+	_, err = RequestFromReader(io.MultiReader(strings.NewReader("GET / HT"), errReader{}))
+	require.ErrorIs(t, err, errBroken)
+	var pErr *ParseError
+	assert.False(t, errors.As(err, &pErr))
+}
+
+var errBroken = errors.New("broken")
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errBroken
+}
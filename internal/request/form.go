@@ -0,0 +1,88 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"strings"
+)
+
+var ErrMalformedForm = errors.New("malformed form")
+
+// ParseForm fills PostForm with the parameters of an
+// application/x-www-form-urlencoded body (for POST, PUT and PATCH requests)
+// and Form with those plus the query parameters, body values first. Bodies
+// larger than maxSize bytes yield an error wrapping ErrBodyTooLarge, bodies
+// that are not properly encoded one wrapping ErrMalformedForm. Calling it
+// again has no effect.
+func (r *Request) ParseForm(maxSize int) error {
+	if r.Form != nil {
+		return nil
+	}
+
+	postForm := make(Values)
+	if r.hasFormBody() {
+		err := r.ReadBody()
+		if err != nil {
+			return err
+		}
+		if len(r.Body) > maxSize {
+			return fmt.Errorf("%w: form exceeds %d bytes", ErrBodyTooLarge, maxSize)
+		}
+		err = parseFormBody(postForm, string(r.Body))
+		if err != nil {
+			return err
+		}
+	}
+
+	form := make(Values)
+	for key, values := range postForm {
+		form[key] = append(form[key], values...)
+	}
+	for key, values := range r.Query() {
+		form[key] = append(form[key], values...)
+	}
+	r.PostForm = postForm
+	r.Form = form
+	return nil
+}
+
+// FormValue returns the first value for key from the body or query, parsing
+// the form if necessary. Parse errors are ignored, and the form is only
+// limited by the size of the body, so call ParseForm first to set a limit.
+func (r *Request) FormValue(key string) string {
+	r.ParseForm(math.MaxInt)
+	return r.Form.Get(key)
+}
+
+func (r *Request) hasFormBody() bool {
+	switch r.RequestLine.Method {
+	case MethodPost, MethodPut, MethodPatch:
+	default:
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Headers.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// parseFormBody is stricter than parseQuery: a single badly encoded pair
+// makes the whole form invalid.
+func parseFormBody(values Values, body string) error {
+	for pair := range strings.SplitSeq(body, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedForm, err)
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedForm, err)
+		}
+		values.Add(key, value)
+	}
+	return nil
+}
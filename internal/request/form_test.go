@@ -0,0 +1,55 @@
+package request
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(t *testing.T, method, target, contentType, body string) *Request {
+	t.Helper()
+	r, err := RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		body))
+	require.NoError(t, err)
+	return r
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: Body and query values are merged, body first
+	r := formRequest(t, "POST", "/order?size=large&cups=1", "application/x-www-form-urlencoded", "drink=flat+white&cups=2&note=50%25")
+	require.NoError(t, r.ParseForm(1<<10))
+	assert.Equal(t, "flat white", r.PostForm.Get("drink"))
+	assert.False(t, r.PostForm.Has("size"))
+	assert.Equal(t, []string{"2", "1"}, r.Form["cups"])
+	assert.Equal(t, "large", r.Form.Get("size"))
+	assert.Equal(t, "50%", r.FormValue("note"))
+
+	// Test: Content-Type parameters are ignored
+	r = formRequest(t, "PUT", "/order", "application/x-www-form-urlencoded; charset=utf-8", "drink=espresso")
+	require.NoError(t, r.ParseForm(1<<10))
+	assert.Equal(t, "espresso", r.Form.Get("drink"))
+
+	// Test: Bodies of other types are not parsed
+	r = formRequest(t, "POST", "/order?size=small", "application/json", `{"drink":"mocha"}`)
+	require.NoError(t, r.ParseForm(1<<10))
+	assert.Empty(t, r.PostForm)
+	assert.Equal(t, "small", r.Form.Get("size"))
+
+	// Test: Malformed body
+	r = formRequest(t, "POST", "/order", "application/x-www-form-urlencoded", "drink=%zz")
+	require.ErrorIs(t, r.ParseForm(1<<10), ErrMalformedForm)
+
+	// Test: Form too large
+	r = formRequest(t, "POST", "/order", "application/x-www-form-urlencoded", "drink=mocha")
+	require.ErrorIs(t, r.ParseForm(10), ErrBodyTooLarge)
+	assert.Nil(t, r.Form)
+	require.NoError(t, r.ParseForm(11))
+	assert.Equal(t, "mocha", r.Form.Get("drink"))
+}
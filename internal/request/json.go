@@ -0,0 +1,50 @@
+package request
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+var (
+	ErrNotJSON       = errors.New("request body is not JSON")
+	ErrMalformedJSON = errors.New("malformed JSON body")
+)
+
+// DecodeJSON decodes a JSON body into v, which must be a pointer. The body
+// has to be declared as application/json (or a +json type), otherwise the
+// error wraps ErrNotJSON. Bodies larger than maxSize bytes yield an error
+// wrapping ErrBodyTooLarge; syntax errors, type mismatches, fields v does
+// not have and data after the value yield one wrapping ErrMalformedJSON.
+func (r *Request) DecodeJSON(v any, maxSize int) error {
+	mediaType, _, err := mime.ParseMediaType(r.Headers.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return ErrNotJSON
+	}
+	err = r.ReadBody()
+	if err != nil {
+		return err
+	}
+	if len(r.Body) > maxSize {
+		return fmt.Errorf("%w: JSON body exceeds %d bytes", ErrBodyTooLarge, maxSize)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(r.Body))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: empty body", ErrMalformedJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedJSON, err)
+	}
+	_, err = decoder.Token()
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: unexpected data after the value", ErrMalformedJSON)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type order struct {
+	Drink string `json:"drink"`
+	Cups  int    `json:"cups"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	// Test: Valid body
+	r := formRequest(t, "POST", "/orders", "application/json; charset=utf-8", `{"drink":"mocha","cups":2}`)
+	var o order
+	require.NoError(t, r.DecodeJSON(&o, 1<<10))
+	assert.Equal(t, order{Drink: "mocha", Cups: 2}, o)
+
+	// Test: Structured syntax suffix
+	r = formRequest(t, "POST", "/orders", "application/vnd.orders+json", `{"drink":"latte"}`)
+	require.NoError(t, r.DecodeJSON(&o, 1<<10))
+	assert.Equal(t, "latte", o.Drink)
+
+	// Test: Wrong Content-Type
+	r = formRequest(t, "POST", "/orders", "text/plain", `{"drink":"mocha"}`)
+	assert.ErrorIs(t, r.DecodeJSON(&o, 1<<10), ErrNotJSON)
+
+	// Test: Unknown field
+	r = formRequest(t, "POST", "/orders", "application/json", `{"drink":"mocha","size":"large"}`)
+	assert.ErrorIs(t, r.DecodeJSON(&o, 1<<10), ErrMalformedJSON)
+
+	// Test: Type mismatch
+	r = formRequest(t, "POST", "/orders", "application/json", `{"cups":"two"}`)
+	assert.ErrorIs(t, r.DecodeJSON(&o, 1<<10), ErrMalformedJSON)
+
+	// Test: Trailing data
+	for _, body := range []string{`{"drink":"mocha"}{}`, `{"drink":"mocha"}}`, `{} x`} {
+		r = formRequest(t, "POST", "/orders", "application/json", body)
+		assert.ErrorIs(t, r.DecodeJSON(&o, 1<<10), ErrMalformedJSON, body)
+	}
+
+	// Test: Empty body
+	r = formRequest(t, "POST", "/orders", "application/json", "")
+	assert.ErrorIs(t, r.DecodeJSON(&o, 1<<10), ErrMalformedJSON)
+
+	// Test: Body too large
+	r = formRequest(t, "POST", "/orders", "application/json", `{"drink":"mocha"}`)
+	assert.ErrorIs(t, r.DecodeJSON(&o, 16), ErrBodyTooLarge)
+	require.NoError(t, r.DecodeJSON(&o, 17))
+}
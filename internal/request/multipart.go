@@ -0,0 +1,426 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+)
+
+const (
+	DefaultMaxParts         = 1000
+	DefaultMaxMultipartSize = DefaultMaxBodyBytes
+)
+
+var (
+	ErrNotMultipart       = errors.New("request is not multipart")
+	ErrTooManyParts       = errors.New("too many multipart parts")
+	ErrMalformedMultipart = errors.New("malformed multipart body")
+	ErrBodyStreamed       = errors.New("request body already read by a MultipartReader")
+)
+
+// MultipartReader streams the parts of a multipart/form-data body (RFC 7578)
+// one after the other, without holding more than a buffer's worth of it in
+// memory.
+type MultipartReader struct {
+	// MaxParts and MaxSize limit the number of parts and the total size of
+	// the body read, in bytes. Going over them yields an error wrapping
+	// ErrTooManyParts or ErrBodyTooLarge.
+	MaxParts int
+	MaxSize  int64
+
+	br             *bufio.Reader
+	dashBoundary   []byte
+	nlDashBoundary []byte
+	numParts       int
+	current        *Part
+	done           bool
+	// readEpilogue makes NextPart read the body to its end after the last
+	// part, so that the request is complete
+	readEpilogue bool
+}
+
+// Part is a single part of a multipart body. Reading from it yields the
+// part's content up to the next boundary.
+type Part struct {
+	Headers headers.Headers
+
+	mr   *MultipartReader
+	done bool
+}
+
+// MultipartReader returns a reader for the parts of a multipart/form-data
+// body, with the boundary taken from the Content-Type header. If the body has
+// not been read yet, as the server leaves it for multipart requests, the
+// reader streams it from the connection, and Body stays empty. The body can
+// only be read once that way.
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Headers.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" || len(boundary) > 70 {
+		return nil, fmt.Errorf("%w: invalid boundary %q", ErrMalformedMultipart, boundary)
+	}
+	body, err := r.streamBody()
+	if err != nil {
+		return nil, err
+	}
+	mr := NewMultipartReader(body, boundary)
+	mr.readEpilogue = true
+	return mr, nil
+}
+
+func NewMultipartReader(reader io.Reader, boundary string) *MultipartReader {
+	mr := &MultipartReader{
+		MaxParts:       DefaultMaxParts,
+		MaxSize:        DefaultMaxMultipartSize,
+		dashBoundary:   []byte("--" + boundary),
+		nlDashBoundary: []byte("\r\n--" + boundary),
+	}
+	mr.br = bufio.NewReader(&limitedReader{reader: reader, mr: mr})
+	return mr
+}
+
+// limitedReader fails once more than MaxSize bytes have been read.
+type limitedReader struct {
+	reader io.Reader
+	mr     *MultipartReader
+	read   int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	remaining := l.mr.MaxSize - l.read
+	if remaining <= 0 {
+		// only fail if there actually is more to read
+		var probe [1]byte
+		n, err := l.reader.Read(probe[:])
+		if n > 0 {
+			return 0, fmt.Errorf("%w: multipart body exceeds %d bytes", ErrBodyTooLarge, l.mr.MaxSize)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// NextPart skips whatever is left of the current part and returns the next
+// one, or io.EOF after the last.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.current != nil {
+		_, err := io.Copy(io.Discard, mr.current)
+		if err != nil {
+			return nil, err
+		}
+		// the part ends right before the CRLF preceding the boundary
+		_, err = mr.br.Discard(len("\r\n"))
+		if err != nil {
+			return nil, mr.unexpected(err)
+		}
+		mr.current = nil
+	}
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if bytes.Equal(trimmed, mr.dashBoundary) {
+			break
+		}
+		if len(trimmed) == len(mr.dashBoundary)+2 && bytes.HasPrefix(trimmed, mr.dashBoundary) && bytes.HasSuffix(trimmed, []byte("--")) {
+			mr.done = true
+			if mr.readEpilogue {
+				_, err := io.Copy(io.Discard, mr.br)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, io.EOF
+		}
+		if mr.numParts > 0 {
+			return nil, fmt.Errorf("%w: expected boundary, got %q", ErrMalformedMultipart, line)
+		}
+		// anything before the first boundary is a preamble to be ignored
+	}
+
+	mr.numParts++
+	if mr.numParts > mr.MaxParts {
+		return nil, fmt.Errorf("%w: more than %d", ErrTooManyParts, mr.MaxParts)
+	}
+
+	h := headers.NewHeaders()
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			// tolerate bare LF line endings; line points into the reader's
+			// buffer, so it must not be appended to in place
+			fixed := make([]byte, 0, len(line)+1)
+			fixed = append(fixed, bytes.TrimSuffix(line, []byte("\n"))...)
+			line = append(fixed, "\r\n"...)
+		}
+		_, done, err := h.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedMultipart, err)
+		}
+		if done {
+			break
+		}
+	}
+
+	mr.current = &Part{Headers: h, mr: mr}
+	return mr.current, nil
+}
+
+func (mr *MultipartReader) readLine() ([]byte, error) {
+	line, err := mr.br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: line too long", ErrMalformedMultipart)
+	}
+	if err != nil {
+		return nil, mr.unexpected(err)
+	}
+	return line, nil
+}
+
+func (mr *MultipartReader) unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %v", ErrMalformedMultipart, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	br := p.mr.br
+	delimiter := p.mr.nlDashBoundary
+
+	_, err := br.Peek(len(delimiter))
+	if err != nil {
+		// there is no room left for the boundary that has to end the part
+		return 0, p.mr.unexpected(err)
+	}
+	buffered, _ := br.Peek(br.Buffered())
+
+	if i := bytes.Index(buffered, delimiter); i >= 0 {
+		if i == 0 {
+			p.done = true
+			return 0, io.EOF
+		}
+		n := copy(b, buffered[:i])
+		br.Discard(n)
+		return n, nil
+	}
+
+	// the end of the buffer could be the start of the delimiter, so hold
+	// that back until more data arrived
+	safe := len(buffered) - len(delimiter) + 1
+	n := copy(b, buffered[:safe])
+	br.Discard(n)
+	return n, nil
+}
+
+// FormName returns the name parameter of the Content-Disposition header.
+func (p *Part) FormName() string {
+	return p.dispositionParam("name")
+}
+
+// FileName returns the filename parameter of the Content-Disposition header,
+// stripped of any directories.
+func (p *Part) FileName() string {
+	filename := p.dispositionParam("filename")
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	return filename
+}
+
+func (p *Part) dispositionParam(name string) string {
+	disposition, params, err := mime.ParseMediaType(p.Headers.Get("Content-Disposition"))
+	if err != nil || disposition != "form-data" {
+		return ""
+	}
+	return params[name]
+}
+
+// MultipartForm holds a fully read multipart form. File contents larger than
+// the memory threshold passed to ReadForm live in temporary files that
+// RemoveAll deletes.
+type MultipartForm struct {
+	Value Values
+	File  map[string][]*FileHeader
+}
+
+type FileHeader struct {
+	Filename string
+	Headers  headers.Headers
+	Size     int64
+
+	content  []byte
+	tempFile string
+}
+
+// Open returns the content of the uploaded file.
+func (fh *FileHeader) Open() (io.ReadSeekCloser, error) {
+	if fh.tempFile != "" {
+		return os.Open(fh.tempFile)
+	}
+	return nopCloser{bytes.NewReader(fh.content)}, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// RemoveAll deletes the temporary files of the form.
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, fileHeaders := range f.File {
+		for _, fh := range fileHeaders {
+			if fh.tempFile != "" {
+				errs = append(errs, os.Remove(fh.tempFile))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadForm reads all remaining parts. Up to maxMemory bytes of values and
+// files are kept in memory; files that do not fit are spilled to temporary
+// files. Values that do not fit yield an error wrapping ErrBodyTooLarge.
+func (mr *MultipartReader) ReadForm(maxMemory int64) (*MultipartForm, error) {
+	form := &MultipartForm{
+		Value: make(Values),
+		File:  make(map[string][]*FileHeader),
+	}
+	err := mr.readForm(form, maxMemory)
+	if err != nil {
+		form.RemoveAll()
+		return nil, err
+	}
+	return form, nil
+}
+
+func (mr *MultipartReader) readForm(form *MultipartForm, maxMemory int64) error {
+	memoryLeft := maxMemory
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, part, memoryLeft+1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		filename := part.FileName()
+		if filename == "" {
+			if n > memoryLeft {
+				return fmt.Errorf("%w: form values exceed %d bytes", ErrBodyTooLarge, maxMemory)
+			}
+			memoryLeft -= n
+			form.Value.Add(name, buf.String())
+			continue
+		}
+
+		fh := &FileHeader{
+			Filename: filename,
+			Headers:  part.Headers,
+		}
+		// the file header is added before spilling, so that RemoveAll cleans
+		// up a temporary file even if writing it fails
+		form.File[name] = append(form.File[name], fh)
+		if n > memoryLeft {
+			fh.Size, err = spill(fh, &buf, part)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		memoryLeft -= n
+		fh.content = buf.Bytes()
+		fh.Size = n
+	}
+}
+
+// spill writes the part of a file already read into buf and the rest of it
+// to a temporary file.
+func spill(fh *FileHeader, buf *bytes.Buffer, rest io.Reader) (int64, error) {
+	file, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return 0, err
+	}
+	fh.tempFile = file.Name()
+	size, err := io.Copy(file, io.MultiReader(buf, rest))
+	closeErr := file.Close()
+	if err != nil {
+		return 0, err
+	}
+	return size, closeErr
+}
+
+// ParseMultipartForm reads a multipart/form-data body into MultipartForm,
+// keeping up to maxMemory bytes in memory, and adds its values to Form and
+// PostForm. The server calls MultipartForm.RemoveAll once the handler
+// returns; other callers should do so once done.
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	// ParseForm leaves multipart bodies alone and only adds the query
+	// parameters, so there is nothing to limit
+	err := r.ParseForm(math.MaxInt)
+	if err != nil {
+		return err
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	form, err := mr.ReadForm(maxMemory)
+	if err != nil {
+		return err
+	}
+	for key, values := range form.Value {
+		r.Form[key] = append(slices.Clone(values), r.Form[key]...)
+		r.PostForm[key] = append(r.PostForm[key], values...)
+	}
+	r.MultipartForm = form
+	return nil
+}
@@ -0,0 +1,224 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const boundary = "X-BOUNDARY-1234"
+
+func multipartBody(fileContent string) string {
+	return "This is the preamble.\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"My holiday\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"photo\"; filename=\"../../beach.jpg\"\r\n" +
+		"Content-Type: image/jpeg\r\n" +
+		"\r\n" +
+		fileContent + "\r\n" +
+		"--" + boundary + "--\r\n" +
+		"This is the epilogue.\r\n"
+}
+
+func multipartRequest(t *testing.T, body string) *Request {
+	t.Helper()
+	reader := &chunkReader{
+		data: "POST /upload?album=summer HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=" + boundary + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" +
+			body,
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	return r
+}
+
+func TestMultipartReader(t *testing.T) {
+	// Test: Parts are streamed one by one with their own headers
+	fileContent := "\xff\xd8 binary \r\n-- not a boundary \r\n--X-BOUNDARY-123"
+	r := multipartRequest(t, multipartBody(fileContent))
+	mr, err := r.MultipartReader()
+	require.NoError(t, err)
+
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.FormName())
+	assert.Equal(t, "", part.FileName())
+	content, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "My holiday", string(content))
+
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "photo", part.FormName())
+	assert.Equal(t, "beach.jpg", part.FileName())
+	assert.Equal(t, "image/jpeg", part.Headers.Get("Content-Type"))
+	content, err = io.ReadAll(iotestOneByteReader{part})
+	require.NoError(t, err)
+	assert.Equal(t, fileContent, string(content))
+
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: Unread parts are skipped
+	mr, err = r.MultipartReader()
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "photo", part.FormName())
+
+	// Test: Part limit
+	mr, err = r.MultipartReader()
+	require.NoError(t, err)
+	mr.MaxParts = 1
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, ErrTooManyParts)
+
+	// Test: Size limit
+	mr, err = r.MultipartReader()
+	require.NoError(t, err)
+	mr.MaxSize = 64
+	_, err = mr.NextPart()
+	if err == nil {
+		_, err = mr.NextPart()
+	}
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Missing closing boundary
+	mr = NewMultipartReader(strings.NewReader("--"+boundary+"\r\n\r\ntruncated"), boundary)
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	_, err = io.ReadAll(part)
+	require.ErrorIs(t, err, ErrMalformedMultipart)
+
+	// Test: Bodies that were not read yet are streamed
+	body := multipartBody(fileContent)
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=" + boundary + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" +
+			body +
+			"GET /next HTTP/1.1\r\n",
+		numBytesPerRead: 7,
+	}
+	r, err = ReadHeaders(reader)
+	require.NoError(t, err)
+	var bodyErrs []error
+	r.OnReadBody(nil, func(err error) {
+		bodyErrs = append(bodyErrs, err)
+	})
+	mr, err = r.MultipartReader()
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	content, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, fileContent, string(content))
+	assert.Empty(t, bodyErrs)
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []error{nil}, bodyErrs)
+	assert.Nil(t, r.Body)
+	// nothing after the body is lost
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /next HTTP/1.1\r\n", string(r.Buffered())+string(rest))
+	require.ErrorIs(t, r.ReadBody(), ErrBodyStreamed)
+	_, err = r.MultipartReader()
+	require.ErrorIs(t, err, ErrBodyStreamed)
+
+	// Test: Streamed body cut short
+	r, err = ReadHeaders(strings.NewReader("POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: multipart/form-data; boundary=" + boundary + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		body[:40]))
+	require.NoError(t, err)
+	mr, err = r.MultipartReader()
+	require.NoError(t, err)
+	part, err = mr.NextPart()
+	if err == nil {
+		_, err = io.ReadAll(part)
+	}
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Not multipart
+	r = formRequest(t, "POST", "/upload", "application/json", "{}")
+	_, err = r.MultipartReader()
+	require.ErrorIs(t, err, ErrNotMultipart)
+}
+
+// iotestOneByteReader reads a single byte at a time to exercise the partial
+// boundary handling.
+type iotestOneByteReader struct {
+	r io.Reader
+}
+
+func (o iotestOneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	// Test: Small file kept in memory
+	r := multipartRequest(t, multipartBody("tiny jpeg"))
+	require.NoError(t, r.ParseMultipartForm(1024))
+	defer r.MultipartForm.RemoveAll()
+	assert.Equal(t, "My holiday", r.FormValue("title"))
+	assert.Equal(t, "summer", r.FormValue("album"))
+	assert.Equal(t, "My holiday", r.PostForm.Get("title"))
+	fh := r.MultipartForm.File["photo"][0]
+	assert.Equal(t, "beach.jpg", fh.Filename)
+	assert.Equal(t, int64(len("tiny jpeg")), fh.Size)
+	assert.Empty(t, fh.tempFile)
+	file, err := fh.Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, "tiny jpeg", string(content))
+
+	// Test: Large file spilled to a temporary file
+	large := string(bytes.Repeat([]byte("sand"), 1000))
+	r = multipartRequest(t, multipartBody(large))
+	require.NoError(t, r.ParseMultipartForm(100))
+	fh = r.MultipartForm.File["photo"][0]
+	assert.Equal(t, int64(len(large)), fh.Size)
+	require.NotEmpty(t, fh.tempFile)
+	file, err = fh.Open()
+	require.NoError(t, err)
+	content, err = io.ReadAll(file)
+	require.NoError(t, err)
+	file.Close()
+	assert.Equal(t, large, string(content))
+	require.NoError(t, r.MultipartForm.RemoveAll())
+	_, err = os.Stat(fh.tempFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: Values that do not fit in memory
+	r = multipartRequest(t, multipartBody("tiny jpeg"))
+	err = r.ParseMultipartForm(4)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
@@ -1,12 +1,14 @@
 package request
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"net"
 	"strings"
-	"unicode"
+	"sync"
 
 	"github.com/roerd/httpfromtcp/internal/headers"
 )
@@ -20,63 +22,406 @@ const (
 	requestStateDone
 )
 
-const bufferSize = 8
+const bufferSize = 4096
+
+// maxPooledBufferSize keeps buffers that were grown for unusually large
+// requests from being held on to by the pool.
+const maxPooledBufferSize = 64 << 10
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+const (
+	MethodGet     = "GET"
+	MethodHead    = "HEAD"
+	MethodPost    = "POST"
+	MethodPut     = "PUT"
+	MethodPatch   = "PATCH"
+	MethodDelete  = "DELETE"
+	MethodConnect = "CONNECT"
+	MethodOptions = "OPTIONS"
+	MethodTrace   = "TRACE"
+)
 
 type Request struct {
-	RequestLine  RequestLine
-	Headers      headers.Headers
+	RequestLine RequestLine
+	Headers     headers.Headers
+	// ContentLength is the length of the body declared in the
+	// Content-Length header, which is validated along with the other
+	// headers, or 0 if there is none.
+	ContentLength int
+	// Body holds the body once ReadBody has been called. The server calls it
+	// before the handler runs, except for requests with Expect: 100-continue,
+	// whose clients only send the body once told to, and for
+	// multipart/form-data bodies, which MultipartReader streams from the
+	// connection instead. Their handlers have to call ReadBody first
+	// (ParseForm, DecodeJSON and the other helpers that use the body do so
+	// themselves), and a handler that never does rejects the body without it
+	// ever being sent.
 	Body         []byte
 	RequestState RequestState
+
+	// Form and PostForm are filled in by ParseForm, MultipartForm by
+	// ParseMultipartForm.
+	Form          Values
+	PostForm      Values
+	MultipartForm *MultipartForm
+
+	reader    io.Reader
+	buf       []byte
+	bufLen    int
+	pooledBuf *[]byte
+	// consumed counts the bytes parsed so far, for error offsets
+	consumed int
+	buffered []byte
+	// bodyErr is the error the body could not be read with
+	bodyErr error
+	// beforeBody and afterBody are set by OnReadBody until they are called
+	beforeBody func() error
+	afterBody  func(err error)
+	// bodyStreamed is set once a MultipartReader reads the body instead of
+	// ReadBody
+	bodyStreamed bool
+
+	maxHeaderBytes int
+	maxBodyBytes   int
+
+	ctx context.Context
+
+	path     string
+	rawPath  string
+	rawQuery string
+	query    Values
 }
 
 type RequestLine struct {
+	// HttpVersion is the version of the request without the "HTTP/" prefix,
+	// e.g. "1.1". Its major version is always 1.
 	HttpVersion   string
 	RequestTarget string
 	Method        string
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := Request{RequestState: requestStateInitialized}
+// ProtoAtLeast reports whether the request's HTTP version is at least
+// major.minor.
+func (rl RequestLine) ProtoAtLeast(major, minor int) bool {
+	if len(rl.HttpVersion) != 3 {
+		return false
+	}
+	reqMajor, reqMinor := int(rl.HttpVersion[0]-'0'), int(rl.HttpVersion[2]-'0')
+	return reqMajor > major || reqMajor == major && reqMinor >= minor
+}
+
+// DefaultMaxHeaderBytes is the default limit for the size of the request
+// line and headers together.
+const DefaultMaxHeaderBytes = 1 << 20
+
+// DefaultMaxBodyBytes is the limit for the size of the body the server
+// applies by default, and the default MaxSize of a MultipartReader.
+// ReadHeaders itself applies none unless given WithMaxBodyBytes.
+const DefaultMaxBodyBytes = 10 << 20
+
+type Option func(*Request)
+
+// WithMaxHeaderBytes limits the size of the request line and headers
+// together. Larger requests fail with ErrHeaderTooLarge.
+func WithMaxHeaderBytes(n int) Option {
+	return func(r *Request) {
+		r.maxHeaderBytes = n
+	}
+}
+
+// WithMaxBodyBytes limits the size of the body. Requests declaring a larger
+// Content-Length fail with ErrBodyTooLarge before any of the body is read.
+// By default there is no limit.
+func WithMaxBodyBytes(n int) Option {
+	return func(r *Request) {
+		r.maxBodyBytes = n
+	}
+}
+
+func RequestFromReader(reader io.Reader, opts ...Option) (*Request, error) {
+	request, err := ReadHeaders(reader, opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = request.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadHeaders reads and parses the request line and headers, but not the
+// body, so that the caller can inspect them (e.g. to answer an Expect header)
+// before calling ReadBody.
+func ReadHeaders(reader io.Reader, opts ...Option) (*Request, error) {
+	pooledBuf := bufferPool.Get().(*[]byte)
+	request := &Request{
+		RequestState:   requestStateInitialized,
+		reader:         reader,
+		buf:            *pooledBuf,
+		pooledBuf:      pooledBuf,
+		maxHeaderBytes: DefaultMaxHeaderBytes,
+	}
+	for _, opt := range opts {
+		opt(request)
+	}
+	err := request.readUntil(requestStateBody)
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadBody reads the rest of a request returned by ReadHeaders. Calling it
+// again returns the result of the first call, and requests that were not
+// read from anywhere have nothing left to read. Once a MultipartReader
+// streamed the body, it fails with ErrBodyStreamed.
+func (r *Request) ReadBody() error {
+	if r.bodyStreamed {
+		return ErrBodyStreamed
+	}
+	if r.RequestState == requestStateDone || r.bodyErr != nil || r.reader == nil {
+		return r.bodyErr
+	}
+	err := r.startBody()
+	if err == nil {
+		err = r.readUntil(requestStateDone)
+	}
+	r.endBody(err)
+	return err
+}
+
+// OnReadBody makes the request call before just before the body is read,
+// whether by ReadBody or a MultipartReader, and after once it has been read
+// completely or reading it failed. It lets the server send a 100 Continue
+// only if the handler wants the body, and know when the connection is past
+// it. If before fails, the body is not read.
+func (r *Request) OnReadBody(before func() error, after func(err error)) {
+	r.beforeBody = before
+	r.afterBody = after
+}
+
+func (r *Request) startBody() error {
+	before := r.beforeBody
+	if before == nil {
+		return nil
+	}
+	r.beforeBody = nil
+	return before()
+}
+
+func (r *Request) endBody(err error) {
+	r.bodyErr = err
+	after := r.afterBody
+	if after == nil {
+		return
+	}
+	r.afterBody = nil
+	after(err)
+}
 
-	buf := make([]byte, bufferSize)
-	totalBytesRead := 0
-	for request.RequestState != requestStateDone {
-		if totalBytesRead >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+// streamBody returns a reader for the body. If it has not been read yet, the
+// reader takes it from the underlying reader as it goes instead of keeping
+// it in Body.
+func (r *Request) streamBody() (io.Reader, error) {
+	if r.bodyStreamed {
+		return nil, ErrBodyStreamed
+	}
+	if r.RequestState == requestStateDone || r.bodyErr != nil || r.reader == nil {
+		if r.bodyErr != nil {
+			return nil, r.bodyErr
 		}
+		return bytes.NewReader(r.Body), nil
+	}
+	r.bodyStreamed = true
+	return &bodyReader{r: r}, nil
+}
 
-		n, err := reader.Read(buf[totalBytesRead:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if request.RequestState != requestStateDone {
-					return nil, fmt.Errorf("error: reached EOF before request was fully parsed")
-				}
-				break
+// bodyReader reads the body of a request that is past its headers without
+// ever holding more than a buffer's worth of it.
+type bodyReader struct {
+	r       *Request
+	started bool
+	read    int
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.r
+	if r.bodyErr != nil {
+		return 0, r.bodyErr
+	}
+	if r.RequestState == requestStateDone {
+		return 0, io.EOF
+	}
+	if !b.started {
+		b.started = true
+		err := r.startBody()
+		if err == nil && r.maxBodyBytes > 0 && r.ContentLength > r.maxBodyBytes {
+			err = &ParseError{
+				Err:    ErrBodyTooLarge,
+				Reason: fmt.Sprintf("more than %d bytes", r.maxBodyBytes),
+				Offset: r.consumed,
 			}
-			return nil, fmt.Errorf("error reading from reader: %v", err)
 		}
-		totalBytesRead += n
+		if err != nil {
+			return 0, b.fail(err)
+		}
+	}
+	if b.read == r.ContentLength {
+		b.finish()
+		return 0, io.EOF
+	}
+
+	// anything after the body is not part of this request
+	p = p[:min(len(p), r.ContentLength-b.read)]
+	var n int
+	if r.bufLen > 0 {
+		n = copy(p, r.buf[:r.bufLen])
+		copy(r.buf, r.buf[n:r.bufLen])
+		r.bufLen -= n
+	} else {
+		var err error
+		n, err = r.reader.Read(p)
+		if n == 0 && err != nil {
+			return 0, b.fail(r.readError(err))
+		}
+	}
+	r.consumed += n
+	b.read += n
+	if b.read == r.ContentLength {
+		// let the server know right away, rather than when the caller
+		// happens to read again
+		b.finish()
+	}
+	return n, nil
+}
+
+func (b *bodyReader) finish() {
+	r := b.r
+	r.RequestState = requestStateDone
+	if r.bufLen > 0 {
+		// the buffer goes back to the pool, so keep a copy
+		r.buffered = bytes.Clone(r.buf[:r.bufLen])
+	}
+	r.releaseBuffer()
+	r.endBody(nil)
+}
+
+func (b *bodyReader) fail(err error) error {
+	b.r.releaseBuffer()
+	b.r.endBody(err)
+	return err
+}
+
+func (r *Request) readUntil(state RequestState) error {
+	err := r.read(state)
+	if err == nil && r.RequestState == requestStateDone && r.bufLen > 0 {
+		// the buffer goes back to the pool, so keep a copy
+		r.buffered = bytes.Clone(r.buf[:r.bufLen])
+	}
+	if err != nil || r.RequestState == requestStateDone {
+		r.releaseBuffer()
+	}
+	return err
+}
+
+// Buffered returns the bytes that were read from the reader after the end of
+// the request, such as the start of a pipelined request or of the data a
+// client sends after asking for a protocol upgrade. They are only known once
+// the whole request has been read.
+func (r *Request) Buffered() []byte {
+	return r.buffered
+}
+
+func (r *Request) read(state RequestState) error {
+	for {
+		data := r.buf[:r.bufLen]
+		// don't let the request line and headers go beyond the limit, even
+		// if they arrived in one piece
+		headerLimited := r.RequestState < requestStateBody && r.consumed+len(data) > r.maxHeaderBytes
+		if headerLimited {
+			data = data[:max(r.maxHeaderBytes-r.consumed, 0)]
+		}
 
-		numBytesConsumed, err := request.parse(buf[:totalBytesRead])
+		numBytesConsumed, err := r.parse(data, state)
 		if err != nil {
-			return nil, err
+			var pErr *ParseError
+			if errors.As(err, &pErr) {
+				pErr.Offset = r.consumed + numBytesConsumed
+			}
+			return err
 		}
 
 		if numBytesConsumed > 0 {
 			// shift the buffer to remove the consumed bytes
-			copy(buf, buf[numBytesConsumed:totalBytesRead])
-			totalBytesRead -= numBytesConsumed
+			copy(r.buf, r.buf[numBytesConsumed:r.bufLen])
+			r.bufLen -= numBytesConsumed
+			r.consumed += numBytesConsumed
+		}
+
+		if r.RequestState >= state {
+			return nil
+		}
+		if headerLimited {
+			if r.RequestState < requestStateBody {
+				return &ParseError{
+					Err:    ErrHeaderTooLarge,
+					Reason: fmt.Sprintf("more than %d bytes", r.maxHeaderBytes),
+					Offset: r.consumed,
+				}
+			}
+			// parse the rest of the buffer before reading more
+			continue
+		}
+
+		if r.bufLen >= len(r.buf) {
+			newBuf := make([]byte, len(r.buf)*2)
+			copy(newBuf, r.buf)
+			r.buf = newBuf
+		}
+
+		n, err := r.reader.Read(r.buf[r.bufLen:])
+		if n == 0 && err != nil {
+			return r.readError(err)
 		}
+		r.bufLen += n
 	}
+}
 
-	return &request, nil
+// readError turns an error from the underlying reader into a ParseError if
+// it is about the request (the client closing the connection or being too
+// slow) rather than about the connection itself.
+func (r *Request) readError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		return &ParseError{Err: ErrIncompleteRequest, Offset: r.consumed + r.bufLen}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &ParseError{Err: ErrTimeout, Offset: r.consumed + r.bufLen}
+	default:
+		return fmt.Errorf("error reading request: %w", err)
+	}
+}
+
+func (r *Request) releaseBuffer() {
+	if r.pooledBuf != nil && len(r.buf) <= maxPooledBufferSize {
+		*r.pooledBuf = r.buf
+		bufferPool.Put(r.pooledBuf)
+	}
+	r.pooledBuf = nil
+	r.buf = nil
+	r.bufLen = 0
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+func (r *Request) parse(data []byte, until RequestState) (int, error) {
 	totalBytesParsed := 0
-	for r.RequestState != requestStateDone {
+	for r.RequestState < until {
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return totalBytesParsed + n, err
@@ -93,7 +438,7 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.RequestState {
 	case requestStateInitialized:
-		requestLine, numBytesConsumed, err := parseRequestLine(string(data))
+		requestLine, numBytesConsumed, err := parseRequestLine(data)
 		if err != nil {
 			return numBytesConsumed, err
 		}
@@ -103,37 +448,55 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, nil
 		}
 
-		r.RequestLine = *requestLine
+		r.RequestLine = requestLine
+		err = r.parseTarget()
+		if err != nil {
+			return 0, parseError(ErrMalformedRequestLine, err.Error())
+		}
 		r.RequestState = requestStateHeaders
 		return numBytesConsumed, nil
 	case requestStateHeaders:
 		if r.Headers == nil {
 			r.Headers = headers.NewHeaders()
 		}
+		prevHost, hadHost := r.Headers["host"]
 		n, done, err := r.Headers.Parse(data)
 		if err != nil {
-			return n, err
+			return 0, parseError(ErrMalformedHeader, err.Error())
+		}
+		if hadHost && r.Headers["host"] != prevHost {
+			return 0, parseError(ErrMalformedHeader, "duplicate Host header")
 		}
 		if done {
+			// HTTP/1.0 clients are not required to send Host
+			if _, ok := r.Headers["host"]; !ok && r.RequestLine.ProtoAtLeast(1, 1) {
+				return 0, parseError(ErrMalformedHeader, "missing Host header")
+			}
+			if value, ok := r.Headers["content-length"]; ok {
+				contentLength, ok := parseContentLength(value)
+				if !ok {
+					// report it where the body would start, like other
+					// problems with the body
+					return n, parseError(ErrInvalidContentLength, fmt.Sprintf("%q", value))
+				}
+				r.ContentLength = contentLength
+			}
 			r.RequestState = requestStateBody
 		}
 		return n, nil
 	case requestStateBody:
-		contentLengthStr := r.Headers.Get("Content-Length")
-		if contentLengthStr == "" {
+		if r.ContentLength == 0 {
 			// no body
 			r.RequestState = requestStateDone
 			return 0, nil
 		}
-		contentLength, err := strconv.Atoi(contentLengthStr)
-		if err != nil {
-			return 0, fmt.Errorf("invalid Content-Length: %v", err)
+		if r.maxBodyBytes > 0 && r.ContentLength > r.maxBodyBytes {
+			return 0, parseError(ErrBodyTooLarge, fmt.Sprintf("more than %d bytes", r.maxBodyBytes))
 		}
+		// anything after the body is not part of this request
+		data = data[:min(len(data), r.ContentLength-len(r.Body))]
 		r.Body = append(r.Body, data...)
-		if len(r.Body) > contentLength {
-			return len(data), fmt.Errorf("body is larger than specified by Content-Length header")
-		}
-		if len(r.Body) == contentLength {
+		if len(r.Body) == r.ContentLength {
 			r.RequestState = requestStateDone
 		}
 		return len(data), nil
@@ -144,41 +507,103 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
-func parseRequestLine(request string) (*RequestLine, int, error) {
-	requestLines := strings.Split(string(request), "\r\n")
+func parseRequestLine(data []byte) (RequestLine, int, error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return RequestLine{}, 0, nil
+	}
+	line := data[:end]
+	numBytesConsumed := end + len("\r\n")
 
-	if len(requestLines) < 2 {
-		return nil, 0, nil
+	if spaces := bytes.Count(line, []byte(" ")); spaces != 2 {
+		return RequestLine{}, 0, parseError(ErrMalformedRequestLine, fmt.Sprintf("wrong number of parts: %v", spaces+1))
 	}
+	method, rest, _ := bytes.Cut(line, []byte(" "))
+	target, version, _ := bytes.Cut(rest, []byte(" "))
 
-	requestLine := requestLines[0]
-	numBytesConsumed := len(requestLines[0]) + len("\r\n")
+	if !headers.IsToken(method) {
+		return RequestLine{}, 0, parseError(ErrMalformedRequestLine, fmt.Sprintf("method is not a valid token: %q", method))
+	}
 
-	parts := strings.Split(requestLine, " ")
-	if len(parts) != 3 {
-		return nil, numBytesConsumed, fmt.Errorf("wrong number of parts in request line: %v", len(parts))
+	if len(target) == 0 {
+		return RequestLine{}, 0, parseError(ErrMalformedRequestLine, "empty request target")
 	}
 
-	method := parts[0]
-	if !hasOnlyCapitalLetters(method) {
-		return nil, numBytesConsumed, fmt.Errorf("method contains a character that is not capital letter: %v", method)
+	if !isHTTPVersion(version) {
+		return RequestLine{}, 0, parseError(ErrMalformedRequestLine, fmt.Sprintf("invalid HTTP version: %q", version))
+	}
+	// every HTTP/1.x request can be served as HTTP/1.1, minor versions
+	// only tell what the client itself supports (RFC 9110, section 2.5)
+	if version[len("HTTP/")] != '1' {
+		return RequestLine{}, 0, parseError(ErrUnsupportedVersion, fmt.Sprintf("%s, only HTTP/1.x is supported", version))
 	}
 
-	target := parts[1]
+	return RequestLine{
+		HttpVersion:   string(version[len("HTTP/"):]),
+		RequestTarget: string(target),
+		Method:        internMethod(method),
+	}, numBytesConsumed, nil
+}
 
-	if parts[2] != "HTTP/1.1" {
-		return nil, numBytesConsumed, fmt.Errorf("unsupported HTTP version: %v", parts[1])
-	}
-	version := strings.Split(parts[2], "/")[1]
+// isHTTPVersion reports whether version has the form "HTTP/x.y" (RFC 9112,
+// section 2.3).
+func isHTTPVersion(version []byte) bool {
+	rest, ok := bytes.CutPrefix(version, []byte("HTTP/"))
+	return ok && len(rest) == 3 && isDigit(rest[0]) && rest[1] == '.' && isDigit(rest[2])
+}
 
-	return &RequestLine{version, target, method}, numBytesConsumed, nil
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
 }
 
-func hasOnlyCapitalLetters(s string) bool {
-	for _, r := range s {
-		if !unicode.IsUpper(r) {
-			return false
+// parseContentLength parses a Content-Length value. Repeated headers reach
+// it joined by commas, which is only acceptable if they all agree (RFC 9110,
+// section 8.6).
+func parseContentLength(value string) (int, bool) {
+	contentLength := -1
+	for part := range strings.SplitSeq(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || len(part) > 18 {
+			return 0, false
 		}
+		n := 0
+		for i := 0; i < len(part); i++ {
+			if !isDigit(part[i]) {
+				return 0, false
+			}
+			n = n*10 + int(part[i]-'0')
+		}
+		if contentLength >= 0 && n != contentLength {
+			return 0, false
+		}
+		contentLength = n
+	}
+	return contentLength, true
+}
+
+// internMethod returns the standard method constants instead of allocating a
+// new string for them.
+func internMethod(method []byte) string {
+	switch string(method) {
+	case MethodGet:
+		return MethodGet
+	case MethodHead:
+		return MethodHead
+	case MethodPost:
+		return MethodPost
+	case MethodPut:
+		return MethodPut
+	case MethodPatch:
+		return MethodPatch
+	case MethodDelete:
+		return MethodDelete
+	case MethodConnect:
+		return MethodConnect
+	case MethodOptions:
+		return MethodOptions
+	case MethodTrace:
+		return MethodTrace
+	default:
+		return string(method)
 	}
-	return true
 }
@@ -1,6 +1,7 @@
 package request
 
 import (
+	"errors"
 	"io"
 	"strings"
 	"testing"
@@ -38,10 +39,22 @@ func TestRequestLineParse(t *testing.T) {
 	_, err = RequestFromReader(strings.NewReader("/coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.Error(t, err)
 
-	// Test: Invalid method (out of order) in request line
-	_, err = RequestFromReader(strings.NewReader("OUT_OF_ORDER /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
+	// Test: Invalid method (non-token characters) in request line
+	_, err = RequestFromReader(strings.NewReader("G(ET) /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.Error(t, err)
 
+	// Test: Invalid method (non-ASCII uppercase letter) in request line
+	_, err = RequestFromReader(strings.NewReader("GÉT /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Extension methods are valid tokens
+	r, err = RequestFromReader(strings.NewReader("M-SEARCH * HTTP/1.1\r\nHost: 239.255.255.250:1900\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "M-SEARCH", r.RequestLine.Method)
+	r, err = RequestFromReader(strings.NewReader("purge /coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "purge", r.RequestLine.Method)
+
 	// Test: Invalid version in request line
 	_, err = RequestFromReader(strings.NewReader("/coffee HTTP/2.0\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.Error(t, err)
@@ -124,10 +137,8 @@ func TestParseHeaders(t *testing.T) {
 		data:            "GET / HTTP/1.1\r\n\r\n",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
-	require.NoError(t, err)
-	require.NotNil(t, r)
-	assert.Empty(t, r.Headers)
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -139,13 +150,37 @@ func TestParseHeaders(t *testing.T) {
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: example.com\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: text/html\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, example.com", r.Headers["host"])
+	assert.Equal(t, "text/html, */*", r.Headers["accept"])
+
+	// Test: Missing Host Header
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Duplicate Host Headers
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Duplicate Host Headers with empty value
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost:\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -233,3 +268,177 @@ func TestParseBody(t *testing.T) {
 	require.NotNil(t, r)
 	require.Nil(t, r.Body)
 }
+
+func TestReadHeadersThenBody(t *testing.T) {
+	// Test: Headers are available before the body is read
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-continue\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 5,
+	}
+	r, err := ReadHeaders(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "100-continue", r.Headers.Get("Expect"))
+	assert.Equal(t, 13, r.ContentLength)
+	assert.Nil(t, r.Body)
+	err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Body arriving in the same read as the headers
+	data := "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello"
+	reader = &chunkReader{
+		data:            data,
+		numBytesPerRead: len(data),
+	}
+	r, err = ReadHeaders(reader)
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+	err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Reading the body again returns the same result
+	require.NoError(t, r.ReadBody())
+	assert.Equal(t, "hello", string(r.Body))
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhel",
+		numBytesPerRead: 8,
+	}
+	r, err = ReadHeaders(reader)
+	require.NoError(t, err)
+	err = r.ReadBody()
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	assert.Equal(t, err, r.ReadBody())
+
+	// Test: OnReadBody runs around the first read of the body only
+	reader = &chunkReader{
+		data:            data,
+		numBytesPerRead: len(data),
+	}
+	r, err = ReadHeaders(reader)
+	require.NoError(t, err)
+	calls := 0
+	r.OnReadBody(func() error {
+		calls++
+		assert.Nil(t, r.Body)
+		return nil
+	}, func(err error) {
+		calls++
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+	})
+	require.NoError(t, r.ReadBody())
+	require.NoError(t, r.ReadBody())
+	assert.Equal(t, 2, calls)
+
+	// Test: The body is not read if OnReadBody's before fails
+	r, err = ReadHeaders(strings.NewReader(data))
+	require.NoError(t, err)
+	errBefore := errors.New("no body wanted")
+	var afterErr error
+	r.OnReadBody(func() error {
+		return errBefore
+	}, func(err error) {
+		afterErr = err
+	})
+	require.ErrorIs(t, r.ReadBody(), errBefore)
+	assert.ErrorIs(t, afterErr, errBefore)
+	assert.Nil(t, r.Body)
+}
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	curlRequest := "GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"
+	reader := strings.NewReader(curlRequest)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(curlRequest)))
+	for b.Loop() {
+		reader.Reset(curlRequest)
+		_, err := RequestFromReader(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRequestFromReaderWithBody(b *testing.B) {
+	curlRequest := "POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"User-Agent: curl/7.81.0\r\n" +
+		"Accept: */*\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 27\r\n" +
+		"\r\n" +
+		`{"coffee":"black","cups":2}`
+	reader := strings.NewReader(curlRequest)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(curlRequest)))
+	for b.Loop() {
+		reader.Reset(curlRequest)
+		_, err := RequestFromReader(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	// Test: Other HTTP/1.x minor versions are accepted
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.2\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.2", r.RequestLine.HttpVersion)
+	assert.True(t, r.RequestLine.ProtoAtLeast(1, 1))
+
+	// Test: HTTP/1.0 does not need a Host header
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.True(t, r.RequestLine.ProtoAtLeast(1, 0))
+	assert.False(t, r.RequestLine.ProtoAtLeast(1, 1))
+
+	// Test: Other major versions are unsupported
+	for _, version := range []string{"HTTP/0.9", "HTTP/2.0", "HTTP/3.0"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost:42069\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrUnsupportedVersion, version)
+	}
+
+	// Test: Versions not matching HTTP/DIGIT.DIGIT are malformed
+	for _, version := range []string{"HTTP/1.10", "HTTP/1", "http/1.1", "HTTP/1.x", "HTTP/11"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost:42069\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrMalformedRequestLine, version)
+	}
+}
+
+func TestBuffered(t *testing.T) {
+	// Test: Bytes after the body are kept
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n",
+		numBytesPerRead: 40,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	// the rest was not read from the reader yet
+	assert.Equal(t, "GET /nex", string(r.Buffered()))
+
+	// Test: Bytes after a request without a body
+	r, err = RequestFromReader(strings.NewReader("GET /chat HTTP/1.1\r\nHost: localhost:42069\r\nUpgrade: websocket\r\n\r\n\x81\x05hello"))
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+	assert.Equal(t, "\x81\x05hello", string(r.Buffered()))
+
+	// Test: Nothing after the request
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Buffered())
+}
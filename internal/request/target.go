@@ -0,0 +1,172 @@
+package request
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Values maps a query or form parameter name to all of its values, in the
+// order they were sent.
+type Values map[string][]string
+
+// Get returns the first value for key, or "" if there is none.
+func (v Values) Get(key string) string {
+	if values := v[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+func (v Values) Set(key, value string) {
+	v[key] = []string{value}
+}
+
+func (v Values) Del(key string) {
+	delete(v, key)
+}
+
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// Path returns the percent-decoded path of the request target, with dot
+// segments resolved and duplicate slashes collapsed, so that "/a/../b",
+// "/a/%2e%2e/b" and "//b" all come out as "/b". A trailing slash is kept.
+// It is "*" for "OPTIONS *" and empty for CONNECT's authority-form.
+func (r *Request) Path() string {
+	return r.path
+}
+
+// RawPath returns the path of the request target exactly as it was sent,
+// without the query.
+func (r *Request) RawPath() string {
+	return r.rawPath
+}
+
+// RawQuery returns the query of the request target without the leading "?",
+// still percent-encoded.
+func (r *Request) RawQuery() string {
+	return r.rawQuery
+}
+
+// Query returns the decoded query parameters. Parameters that are not
+// properly percent-encoded are skipped.
+func (r *Request) Query() Values {
+	if r.query == nil {
+		r.query = parseQuery(r.rawQuery)
+	}
+	return r.query
+}
+
+// parseTarget splits the request target into path and query, see RFC 9112,
+// section 3.2.
+func (r *Request) parseTarget() error {
+	target := r.RequestLine.RequestTarget
+	switch {
+	case target == "*":
+		r.rawPath, r.path = target, target
+		return nil
+	case r.RequestLine.Method == MethodConnect:
+		// authority-form has no path
+		return nil
+	}
+
+	if scheme, rest, ok := strings.Cut(target, "://"); ok && !strings.Contains(scheme, "/") {
+		// absolute-form: drop the scheme and authority
+		i := strings.IndexAny(rest, "/?")
+		if i < 0 {
+			target = "/"
+		} else {
+			target = rest[i:]
+		}
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	decoded, err := unescape(rawPath, false)
+	if err != nil {
+		return fmt.Errorf("invalid request target %q: %v", r.RequestLine.RequestTarget, err)
+	}
+	r.rawPath = rawPath
+	r.rawQuery = rawQuery
+	r.path = cleanPath(decoded)
+	return nil
+}
+
+// cleanPath resolves dot segments and collapses duplicate slashes, keeping a
+// trailing slash.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func parseQuery(rawQuery string) Values {
+	values := make(Values)
+	for pair := range strings.SplitSeq(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			continue
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			continue
+		}
+		values.Add(key, value)
+	}
+	return values
+}
+
+// unescape decodes percent-encoded octets. In query components "+" stands
+// for a space as well.
+func unescape(s string, query bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("truncated escape %q", s[i:])
+			}
+			hi, ok1 := unhex(s[i+1])
+			lo, ok2 := unhex(s[i+2])
+			if !ok1 || !ok2 {
+				return "", fmt.Errorf("invalid escape %q", s[i:i+3])
+			}
+			b.WriteByte(hi<<4 | lo)
+			i += 2
+		case c == '+' && query:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
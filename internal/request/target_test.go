@@ -0,0 +1,77 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func requestWithTarget(t *testing.T, method, target string) (*Request, error) {
+	t.Helper()
+	return RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+}
+
+func TestRequestTarget(t *testing.T) {
+	// Test: Path and query
+	r, err := requestWithTarget(t, "GET", "/coffee?size=large&milk=oat&milk=soy")
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.Path())
+	assert.Equal(t, "/coffee", r.RawPath())
+	assert.Equal(t, "size=large&milk=oat&milk=soy", r.RawQuery())
+	assert.Equal(t, "large", r.Query().Get("size"))
+	assert.Equal(t, []string{"oat", "soy"}, r.Query()["milk"])
+	assert.False(t, r.Query().Has("sugar"))
+
+	// Test: Percent-decoding
+	r, err = requestWithTarget(t, "GET", "/caf%C3%A9/menu?q=flat+white&note=50%25%20off")
+	require.NoError(t, err)
+	assert.Equal(t, "/café/menu", r.Path())
+	assert.Equal(t, "/caf%C3%A9/menu", r.RawPath())
+	assert.Equal(t, "flat white", r.Query().Get("q"))
+	assert.Equal(t, "50% off", r.Query().Get("note"))
+
+	// Test: Dot segments and duplicate slashes
+	for target, expected := range map[string]string{
+		"/a/../b":           "/b",
+		"/a/%2e%2e/b":       "/b",
+		"/a/%2E%2E/%2e%2e/": "/",
+		"//b":               "/b",
+		"/a/./b//c/":        "/a/b/c/",
+		"/../../etc/passwd": "/etc/passwd",
+	} {
+		r, err = requestWithTarget(t, "GET", target)
+		require.NoError(t, err)
+		assert.Equal(t, expected, r.Path(), target)
+	}
+
+	// Test: Absolute-form
+	r, err = requestWithTarget(t, "GET", "http://localhost:42069/coffee?size=small")
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.Path())
+	assert.Equal(t, "small", r.Query().Get("size"))
+	r, err = requestWithTarget(t, "GET", "http://localhost:42069")
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.Path())
+
+	// Test: Asterisk-form and authority-form
+	r, err = requestWithTarget(t, "OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, "*", r.Path())
+	r, err = requestWithTarget(t, "CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Path())
+
+	// Test: Invalid escapes
+	_, err = requestWithTarget(t, "GET", "/caf%C")
+	require.Error(t, err)
+	_, err = requestWithTarget(t, "GET", "/%zz")
+	require.Error(t, err)
+
+	// Test: Invalid query escapes are skipped
+	r, err = requestWithTarget(t, "GET", "/?bad=%zz&good=1")
+	require.NoError(t, err)
+	assert.False(t, r.Query().Has("bad"))
+	assert.Equal(t, "1", r.Query().Get("good"))
+}
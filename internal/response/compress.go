@@ -0,0 +1,198 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+)
+
+// minCompressSize is the smallest body worth compressing; below it the
+// gzip/zlib framing tends to outweigh the savings.
+const minCompressSize = 256
+
+// compressor is implemented by both gzip.Writer and zlib.Writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// EnableCompression makes the writer compress eligible bodies with the best
+// coding the client accepts according to acceptEncoding, the value of the
+// request's Accept-Encoding header. Compressed bodies of unknown length are
+// sent chunked, buffered ones get a recomputed Content-Length, and every
+// response that could have been compressed carries Vary: Accept-Encoding.
+// It has to be called before the headers are written.
+func (w *Writer) EnableCompression(acceptEncoding string) {
+	w.compress = true
+	w.encoding = negotiateEncoding(acceptEncoding)
+}
+
+// applyCompression is called with the headers right before they are written.
+// If the body should be compressed on the fly, it switches them to chunked
+// transfer coding and sets up the compressor the body is written through.
+func (w *Writer) applyCompression(h headers.Headers) {
+	if !w.compress || h.Get("Content-Encoding") != "" || !w.statusAllowsBody() {
+		return
+	}
+	if !compressibleType(h.Get("Content-Type")) {
+		return
+	}
+	addVary(h, "Accept-Encoding")
+	if w.encoding == "" {
+		return
+	}
+	if contentLength, err := strconv.Atoi(h.Get("Content-Length")); err == nil && contentLength < minCompressSize {
+		return
+	}
+
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Encoding", w.encoding)
+	if !w.omitBody {
+		w.compressor = newCompressor(w.encoding, chunkSink{w})
+	}
+}
+
+// compressBuffered compresses a fully buffered body, so that it can still be
+// sent with a Content-Length.
+func (w *Writer) compressBuffered(body []byte) ([]byte, error) {
+	if !w.compress || w.header.Get("Content-Encoding") != "" || !w.statusAllowsBody() {
+		return body, nil
+	}
+	if !compressibleType(w.header.Get("Content-Type")) {
+		return body, nil
+	}
+	// the response depends on Accept-Encoding even if this one is sent
+	// uncompressed
+	addVary(w.header, "Accept-Encoding")
+	if w.encoding == "" || len(body) < minCompressSize {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	c := newCompressor(w.encoding, &buf)
+	_, err := c.Write(body)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Close()
+	if err != nil {
+		return nil, err
+	}
+	w.header.Set("Content-Encoding", w.encoding)
+	return buf.Bytes(), nil
+}
+
+func (w *Writer) statusAllowsBody() bool {
+	return w.statusCode >= 200 && w.statusCode != 204 && w.statusCode != 304
+}
+
+// chunkSink frames everything a compressor emits as chunks.
+type chunkSink struct {
+	w *Writer
+}
+
+func (s chunkSink) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// an empty chunk would end the body
+		return 0, nil
+	}
+	_, err := s.w.writeChunk(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func newCompressor(encoding string, w io.Writer) compressor {
+	if encoding == "deflate" {
+		// the "deflate" content coding is the zlib format (RFC 1950), not a
+		// raw deflate stream
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// negotiateEncoding picks the content coding to use for a request's
+// Accept-Encoding header, preferring gzip over deflate on equal weights. It
+// returns "" if the client accepts neither.
+func negotiateEncoding(acceptEncoding string) string {
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		qvalues[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, ok := qvalues[coding]
+		if !ok {
+			q, ok = qvalues["x-"+coding]
+		}
+		if !ok {
+			q = qvalues["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether bodies of the given media type are worth
+// compressing. Formats that are already compressed, such as video/mp4 or
+// image/png, are not.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	if strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(h headers.Headers, field string) {
+	vary := h.Get("Vary")
+	for _, existing := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(existing), field) {
+			return
+		}
+	}
+	if vary == "" {
+		h.Set("Vary", field)
+		return
+	}
+	h.Set("Vary", vary+", "+field)
+}
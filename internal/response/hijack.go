@@ -0,0 +1,77 @@
+package response
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrHijacked      = errors.New("connection has been hijacked")
+	ErrNotHijackable = errors.New("connection cannot be hijacked")
+)
+
+// HijackFunc hands the connection over to a handler. It returns a reader
+// that yields the bytes the client already sent after its request before
+// reading from the connection.
+type HijackFunc func() (net.Conn, *bufio.Reader, error)
+
+// EnableHijack makes Hijack available. The server calls it with a function
+// that stops its own use of the connection.
+func (w *Writer) EnableHijack(hijack HijackFunc) {
+	w.hijack = hijack
+}
+
+// Hijack lets the handler take over the connection, e.g. after a 101
+// Switching Protocols for a WebSocket or a 200 for a CONNECT tunnel. What was
+// written so far is sent first, including the headers set through Header if
+// only the status line was written explicitly. Reading from the returned
+// ReadWriter yields the bytes the client already sent before the rest.
+//
+// Afterwards the writer cannot be used any more and the server neither
+// finishes the response nor closes the connection; that is up to the
+// handler.
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.hijack == nil:
+		return nil, nil, ErrNotHijackable
+	case w.writerState == WriterStateHijacked:
+		return nil, nil, ErrHijacked
+	case w.preempted.Load():
+		return nil, nil, ErrPreempted
+	case w.writerState == WriterStateFinished:
+		return nil, nil, fmt.Errorf("response already finished")
+	}
+	// the connection is the handler's from now on, so Preempt must not
+	// write to it, even if no status line was written
+	w.statusWritten = true
+
+	if w.writerState == WriterStateStatusLineWritten {
+		err := w.WriteHeaders(w.header)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = w.writer.Write(w.buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.buffered = nil
+	}
+	err := w.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, reader, err := w.hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.writerState = WriterStateHijacked
+	w.writer.Reset(nil)
+	bufferedWriterPool.Put(w.writer)
+	w.writer = nil
+	return conn, bufio.NewReadWriter(reader, bufio.NewWriter(conn)), nil
+}
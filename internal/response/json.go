@@ -0,0 +1,95 @@
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// WriteJSON sends v, encoded as JSON, as the whole response, with the given
+// status code, Content-Type application/json and a Content-Length. v is
+// encoded before anything is written, so when it fails the handler can still
+// send an error response instead.
+func (w *Writer) WriteJSON(statusCode StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	err = w.WriteStatusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	w.header.Set("Content-Type", "application/json")
+	w.header.Set("Content-Length", strconv.Itoa(len(body)))
+	err = w.writeImplicitHeaders()
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+// JSONArray streams a JSON array element by element, so that large results
+// don't have to be held in memory. Small arrays still go out with a
+// Content-Length, larger ones are sent chunked.
+type JSONArray struct {
+	w      *Writer
+	buf    bytes.Buffer
+	count  int
+	closed bool
+}
+
+// StartJSONArray writes the status line and starts a JSON array response.
+// Elements are added with Encode, and Close ends the array.
+func (w *Writer) StartJSONArray(statusCode StatusCode) (*JSONArray, error) {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		return nil, err
+	}
+	w.header.Set("Content-Type", "application/json")
+	a := &JSONArray{w: w}
+	a.buf.WriteByte('[')
+	return a, nil
+}
+
+// Encode appends v to the array.
+func (a *JSONArray) Encode(v any) error {
+	if a.closed {
+		return fmt.Errorf("JSON array already closed")
+	}
+	element, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if a.count > 0 {
+		a.buf.WriteByte(',')
+	}
+	a.buf.Write(element)
+	a.count++
+	// collect elements into writes of a reasonable size instead of sending
+	// a chunk for each one
+	if a.buf.Len() >= maxBufferedBody {
+		return a.flush()
+	}
+	return nil
+}
+
+// Close ends the array. The response is complete once the writer is
+// finished.
+func (a *JSONArray) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	a.buf.WriteString("]\n")
+	return a.flush()
+}
+
+func (a *JSONArray) flush() error {
+	_, err := a.w.Write(a.buf.Bytes())
+	a.buf.Reset()
+	return err
+}
@@ -1,9 +1,19 @@
 package response
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/roerd/httpfromtcp/internal/cookie"
 	"github.com/roerd/httpfromtcp/internal/headers"
 )
 
@@ -11,26 +21,94 @@ type StatusCode int
 
 func (s StatusCode) String() string {
 	switch s {
+	case statusContinue:
+		return "Continue"
+	case statusSwitchingProtocols:
+		return "Switching Protocols"
+	case statusEarlyHints:
+		return "Early Hints"
 	case statusOK:
 		return "OK"
+	case statusCreated:
+		return "Created"
+	case statusNoContent:
+		return "No Content"
+	case statusNotModified:
+		return "Not Modified"
 	case statusClientError:
 		return "Bad Request"
+	case statusForbidden:
+		return "Forbidden"
+	case statusNotFound:
+		return "Not Found"
+	case statusMethodNotAllowed:
+		return "Method Not Allowed"
+	case statusRequestTimeout:
+		return "Request Timeout"
+	case statusContentTooLarge:
+		return "Content Too Large"
+	case statusUnsupportedMediaType:
+		return "Unsupported Media Type"
+	case statusExpectationFailed:
+		return "Expectation Failed"
+	case statusMisdirectedRequest:
+		return "Misdirected Request"
+	case statusUpgradeRequired:
+		return "Upgrade Required"
+	case statusHeaderFieldsTooLarge:
+		return "Request Header Fields Too Large"
 	case statusServerError:
 		return "Internal Server Error"
+	case statusNotImplemented:
+		return "Not Implemented"
+	case statusBadGateway:
+		return "Bad Gateway"
+	case statusServiceUnavailable:
+		return "Service Unavailable"
+	case statusVersionNotSupported:
+		return "HTTP Version Not Supported"
 	default:
 		return ""
 	}
 }
 
 const (
-	statusOK          StatusCode = 200
-	statusClientError StatusCode = 400
-	statusServerError StatusCode = 500
+	statusContinue             StatusCode = 100
+	statusSwitchingProtocols   StatusCode = 101
+	statusEarlyHints           StatusCode = 103
+	statusOK                   StatusCode = 200
+	statusCreated              StatusCode = 201
+	statusNoContent            StatusCode = 204
+	statusNotModified          StatusCode = 304
+	statusClientError          StatusCode = 400
+	statusForbidden            StatusCode = 403
+	statusNotFound             StatusCode = 404
+	statusMethodNotAllowed     StatusCode = 405
+	statusRequestTimeout       StatusCode = 408
+	statusContentTooLarge      StatusCode = 413
+	statusUnsupportedMediaType StatusCode = 415
+	statusExpectationFailed    StatusCode = 417
+	statusMisdirectedRequest   StatusCode = 421
+	statusUpgradeRequired      StatusCode = 426
+	statusHeaderFieldsTooLarge StatusCode = 431
+	statusServerError          StatusCode = 500
+	statusNotImplemented       StatusCode = 501
+	statusBadGateway           StatusCode = 502
+	statusServiceUnavailable   StatusCode = 503
+	statusVersionNotSupported  StatusCode = 505
 )
 
+// WriteStatusLine writes the status line. It always claims HTTP/1.1, the
+// highest version the server conforms to, whatever the minor version of the
+// request (RFC 9112, section 2.3).
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusCode.String())
-	_, err := w.Write([]byte(statusLine))
+	statusLine := make([]byte, 0, 64)
+	statusLine = append(statusLine, "HTTP/1.1 "...)
+	statusLine = strconv.AppendInt(statusLine, int64(statusCode), 10)
+	statusLine = append(statusLine, ' ')
+	statusLine = append(statusLine, statusCode.String()...)
+	statusLine = append(statusLine, "\r\n"...)
+	_, err := w.Write(statusLine)
 	return err
 }
 
@@ -46,15 +124,37 @@ func GetNewHeaders() headers.Headers {
 	return headers.NewHeaders()
 }
 
+// WriteHeaders writes the header block, including the blank line ending it,
+// with a single call to w.Write.
 func WriteHeaders(w io.Writer, headers headers.Headers) error {
+	return writeHeaders(w, headers, nil)
+}
+
+// writeHeaders writes the header block with a separate Set-Cookie line for
+// each of setCookies, which cannot be joined into one field like the others
+// (RFC 6265, section 3).
+func writeHeaders(w io.Writer, headers headers.Headers, setCookies []string) error {
+	size := len("\r\n")
 	for key, value := range headers {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.Write([]byte(headerLine))
-		if err != nil {
-			return err
-		}
+		size += len(key) + len(": ") + len(value) + len("\r\n")
 	}
-	_, err := w.Write([]byte("\r\n"))
+	for _, value := range setCookies {
+		size += len("set-cookie: ") + len(value) + len("\r\n")
+	}
+	block := make([]byte, 0, size)
+	for key, value := range headers {
+		block = append(block, key...)
+		block = append(block, ": "...)
+		block = append(block, value...)
+		block = append(block, "\r\n"...)
+	}
+	for _, value := range setCookies {
+		block = append(block, "set-cookie: "...)
+		block = append(block, value...)
+		block = append(block, "\r\n"...)
+	}
+	block = append(block, "\r\n"...)
+	_, err := w.Write(block)
 	return err
 }
 
@@ -66,25 +166,161 @@ const (
 	WriterStateHeadersWritten
 	WriterStateBodyWritten
 	WriterStateTrailersWritten
+	WriterStateFinished
+	WriterStateHijacked
 )
 
+// maxBufferedBody is how much of a body written through Write is held back
+// to compute its Content-Length before the writer switches to chunked
+// transfer coding.
+const maxBufferedBody = 4096
+
+// Writer writes a response to a connection. Handlers can either drive it
+// explicitly, with WriteStatusLine, WriteHeaders and one of the WriteBody
+// variants, or just set headers through Header and stream the body with
+// Write, in which case the writer picks the framing itself: bodies up to
+// maxBufferedBody bytes get a Content-Length, larger ones are sent chunked.
+// Finish completes whatever the handler left unfinished.
+//
+// Output is collected in a pooled bufio.Writer, so that the status line,
+// headers and a small body go out in a single write to the connection. It is
+// flushed when the response is finished; streaming handlers can call Flush
+// to push out what they have written so far.
 type Writer struct {
-	writer      io.Writer
+	conn        io.Writer
+	writer      *bufio.Writer
 	writerState WriterState
+	omitBody    bool
+	header      headers.Headers
+	cookies     []string
+	buffered    []byte
+	chunked     bool
+	statusCode  StatusCode
+	compress    bool
+	encoding    string
+	compressor  compressor
+	noChunking  bool
+	hijack      HijackFunc
+	// trailers holds the lowercased names declared in the Trailer header.
+	trailers map[string]bool
+
+	// mu orders writing the status line against Preempt, which may be
+	// called from another goroutine. statusWritten is guarded by it.
+	mu            sync.Mutex
+	statusWritten bool
+	preempted     atomic.Bool
+}
+
+// ErrPreempted is returned by a writer's methods once Preempt has sent a
+// response in place of the handler's.
+var ErrPreempted = errors.New("response preempted")
+
+const bufferedWriterSize = 8192
+
+var bufferedWriterPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, bufferedWriterSize)
+	},
 }
 
 func NewWriter(writer io.Writer) *Writer {
+	bw := bufferedWriterPool.Get().(*bufio.Writer)
+	bw.Reset(writer)
 	return &Writer{
-		writer:      writer,
+		conn:        writer,
+		writer:      bw,
 		writerState: WriterStateInitial,
+		header:      headers.NewHeaders(),
+	}
+}
+
+// Header returns the headers sent when the writer picks the framing itself,
+// i.e. when the body is written with Write without calling WriteHeaders.
+// Changing them after the first body bytes went out has no effect.
+func (w *Writer) Header() headers.Headers {
+	return w.header
+}
+
+// DisableChunking is for clients that don't understand chunked transfer
+// coding, i.e. HTTP/1.0 ones (RFC 9112, section 6.1). Bodies that would be
+// sent chunked are sent as they are instead, without trailers, and end when
+// the connection is closed. Since these clients don't understand interim
+// responses either (RFC 9110, section 15.2), WriteInformational sends
+// nothing to them.
+func (w *Writer) DisableChunking() {
+	w.noChunking = true
+}
+
+// SetCookie adds a Set-Cookie header for c to the response. Each cookie goes
+// out on a line of its own, whether the headers are written implicitly or
+// with WriteHeaders, so it has to be called before either.
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if w.writerState >= WriterStateHeadersWritten {
+		return fmt.Errorf("headers already written")
+	}
+	err := c.Valid()
+	if err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c.String())
+	return nil
+}
+
+// OmitBody makes the writer drop every body byte (and any trailers) while
+// still sending the status line and headers unchanged, as required for
+// responses to HEAD requests.
+func (w *Writer) OmitBody() {
+	w.omitBody = true
+}
+
+// WriteInformational sends an interim 1xx response, such as 100 Continue or
+// 103 Early Hints, ahead of the final response. It can be called any number
+// of times before WriteStatusLine. The headers may be nil. After
+// DisableChunking it does nothing, as HTTP/1.0 clients must not get 1xx
+// responses.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.preempted.Load() {
+		return ErrPreempted
+	}
+	if w.writerState != WriterStateInitial {
+		return fmt.Errorf("status line already written")
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == 101 {
+		return fmt.Errorf("not an informational status code: %d", statusCode)
+	}
+	if w.noChunking {
+		return nil
+	}
+	err := WriteStatusLine(w.writer, statusCode)
+	if err != nil {
+		return err
+	}
+	err = WriteHeaders(w.writer, h)
+	if err != nil {
+		return err
 	}
+	// the client is waiting for this before it carries on, so don't hold it
+	// back until the final response
+	return w.writer.Flush()
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.preempted.Load() {
+		return ErrPreempted
+	}
+	if w.writerState == WriterStateHijacked {
+		return ErrHijacked
+	}
 	if w.writerState != WriterStateInitial {
 		return fmt.Errorf("status line already written")
 	}
+	w.statusWritten = true
 	w.writerState = WriterStateStatusLineWritten
+	w.statusCode = statusCode
 	return WriteStatusLine(w.writer, statusCode)
 }
 
@@ -92,8 +328,297 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	if w.writerState != WriterStateStatusLineWritten {
 		return fmt.Errorf("status line not written")
 	}
+	trailers, err := declaredTrailers(headers.Get("Trailer"))
+	if err != nil {
+		return err
+	}
 	w.writerState = WriterStateHeadersWritten
-	return WriteHeaders(w.writer, headers)
+	w.trailers = trailers
+	w.applyCompression(headers)
+	w.chunked = strings.Contains(strings.ToLower(headers.Get("Transfer-Encoding")), "chunked")
+	if w.chunked && w.noChunking {
+		headers.Delete("Transfer-Encoding")
+		headers.Delete("Trailer")
+		headers.Set("Connection", "close")
+	}
+	return writeHeaders(w.writer, headers, w.cookies)
+}
+
+// Write writes body bytes, sending a 200 status line first if none was
+// written yet. Without explicit headers the body is buffered up to
+// maxBufferedBody bytes and then sent chunked; after WriteHeaders it is
+// framed according to those headers.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.writerState == WriterStateHijacked {
+		return 0, ErrHijacked
+	}
+	if w.writerState == WriterStateInitial {
+		err := w.WriteStatusLine(statusOK)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	switch w.writerState {
+	case WriterStateStatusLineWritten:
+		if len(p) > 0 && !w.statusAllowsBody() {
+			return 0, fmt.Errorf("status %d does not allow a body", w.statusCode)
+		}
+		w.buffered = append(w.buffered, p...)
+		if len(w.buffered) <= maxBufferedBody {
+			return len(p), nil
+		}
+		err := w.startChunked()
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	case WriterStateHeadersWritten:
+		var err error
+		if w.chunked {
+			_, err = w.WriteChunkedBody(p)
+		} else if !w.omitBody {
+			_, err = w.writer.Write(p)
+		}
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	default:
+		return 0, fmt.Errorf("body already written")
+	}
+}
+
+// ReadFrom copies the body from src. When src is an *os.File, the file is
+// sent with a Content-Length (unless a body was already started) and, as
+// long as the body is neither chunked nor otherwise transformed and the
+// connection is a *net.TCPConn, handed to the kernel (sendfile/splice) without
+// passing through user space. Everything else falls back to a buffered copy
+// through Write.
+//
+// Note that io.Copy(w, file) uses the file's WriteTo rather than this method,
+// so call w.ReadFrom(file) directly to get the fast path.
+func (w *Writer) ReadFrom(src io.Reader) (int64, error) {
+	if w.writerState == WriterStateInitial {
+		err := w.WriteStatusLine(statusOK)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if w.writerState == WriterStateStatusLineWritten && len(w.buffered) == 0 && w.statusAllowsBody() {
+		if size, ok := remainingFileSize(src); ok {
+			w.header.Set("Content-Length", strconv.FormatInt(size, 10))
+			err := w.writeImplicitHeaders()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if w.writerState == WriterStateHeadersWritten && !w.chunked {
+		if w.omitBody {
+			return 0, nil
+		}
+		file, isFile := src.(*os.File)
+		conn, isTCP := w.conn.(*net.TCPConn)
+		if isFile && isTCP {
+			err := w.writer.Flush()
+			if err != nil {
+				return 0, err
+			}
+			return conn.ReadFrom(file)
+		}
+	}
+
+	return io.Copy(writerOnly{w}, src)
+}
+
+// writerOnly hides the ReadFrom method of a Writer, so that io.Copy does not
+// call back into it.
+type writerOnly struct {
+	io.Writer
+}
+
+// remainingFileSize returns the number of bytes left to read from src if it
+// is a regular file.
+func remainingFileSize(src io.Reader) (int64, bool) {
+	file, ok := src.(*os.File)
+	if !ok {
+		return 0, false
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size() - offset, true
+}
+
+// Flush sends everything written so far to the connection. If the framing
+// was left to the writer, the body can no longer get a Content-Length, so
+// the headers are sent for a chunked body, followed by what was buffered.
+func (w *Writer) Flush() error {
+	if w.preempted.Load() {
+		return ErrPreempted
+	}
+	if w.writerState == WriterStateHijacked {
+		return ErrHijacked
+	}
+	if w.writerState == WriterStateFinished {
+		return fmt.Errorf("response already finished")
+	}
+	if w.writerState == WriterStateStatusLineWritten {
+		var err error
+		if w.statusAllowsBody() {
+			err = w.startChunked()
+		} else {
+			err = w.writeImplicitHeaders()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if w.compressor != nil {
+		err := w.compressor.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return w.writer.Flush()
+}
+
+// Preempt sends a complete response with the given status code, headers and
+// body directly to the connection, in place of the one the handler is about
+// to write, provided that the handler has not written the status line yet.
+// It reports whether it did. Unlike the other methods it is safe to call
+// while the handler is using the writer from another goroutine. Afterwards,
+// all of the handler's writes fail with ErrPreempted and Finish does
+// nothing, so the handler can no longer touch the connection.
+func (w *Writer) Preempt(statusCode StatusCode, h headers.Headers, body []byte) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.statusWritten || w.preempted.Load() {
+		return false
+	}
+	w.preempted.Store(true)
+
+	var buf bytes.Buffer
+	WriteStatusLine(&buf, statusCode)
+	WriteHeaders(&buf, h)
+	if !w.omitBody {
+		buf.Write(body)
+	}
+	// nothing is held in the handler's buffer before the status line, so
+	// this cannot interleave with its output. An error means the client is
+	// gone, which leaves nothing to do.
+	w.conn.Write(buf.Bytes())
+	return true
+}
+
+// Finish completes the response once the handler is done with it: it sends
+// a 200 status line if nothing was written, the headers and buffered body if
+// the framing was left to the writer, and the last chunk of a chunked body
+// that was not terminated. It then flushes the output; the writer cannot be
+// used afterwards.
+func (w *Writer) Finish() error {
+	if w.preempted.Load() {
+		// the preempted handler may still be using the writer, so leave it
+		// alone
+		return nil
+	}
+	if w.writerState == WriterStateFinished || w.writerState == WriterStateHijacked {
+		return nil
+	}
+	err := w.finishBody()
+	if err == nil {
+		err = w.writer.Flush()
+	}
+	w.writerState = WriterStateFinished
+	w.writer.Reset(nil)
+	bufferedWriterPool.Put(w.writer)
+	w.writer = nil
+	return err
+}
+
+func (w *Writer) finishBody() error {
+	if w.writerState == WriterStateInitial {
+		err := w.WriteStatusLine(statusOK)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch w.writerState {
+	case WriterStateStatusLineWritten:
+		body := w.buffered
+		w.buffered = nil
+		if !w.statusAllowsBody() {
+			// 1xx, 204 and 304 responses have neither a body nor framing
+			// headers (RFC 9110, section 8.6)
+			return w.writeImplicitHeaders()
+		}
+		if len(body) > 0 && w.header.Get("Content-Type") == "" {
+			w.header.Set("Content-Type", "text/plain")
+		}
+		body, err := w.compressBuffered(body)
+		if err != nil {
+			return err
+		}
+		w.header.Set("Content-Length", strconv.Itoa(len(body)))
+		err = w.writeImplicitHeaders()
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteBody(body)
+		return err
+	case WriterStateHeadersWritten:
+		if !w.chunked {
+			w.writerState = WriterStateBodyWritten
+			return nil
+		}
+		_, err := w.WriteChunkedBodyDone()
+		if err != nil {
+			return err
+		}
+		return w.WriteTrailers(nil)
+	case WriterStateBodyWritten:
+		if !w.chunked {
+			return nil
+		}
+		// the last chunk went out, but the message still has to end with
+		// an empty trailer section
+		return w.WriteTrailers(nil)
+	default:
+		return nil
+	}
+}
+
+// startChunked sends the headers set through Header for a chunked body,
+// followed by the body buffered so far.
+func (w *Writer) startChunked() error {
+	w.header.Delete("Content-Length")
+	w.header.Set("Transfer-Encoding", "chunked")
+	err := w.writeImplicitHeaders()
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteChunkedBody(w.buffered)
+	w.buffered = nil
+	return err
+}
+
+func (w *Writer) writeImplicitHeaders() error {
+	if w.header.Get("Connection") == "" {
+		w.header.Set("Connection", "close")
+	}
+	if w.header.Get("Content-Type") == "" && w.header.Get("Content-Length") != "0" && w.statusAllowsBody() {
+		w.header.Set("Content-Type", "text/plain")
+	}
+	return w.WriteHeaders(w.header)
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
@@ -101,6 +626,24 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("headers not written")
 	}
 	w.writerState = WriterStateBodyWritten
+	if w.omitBody {
+		return len(p), nil
+	}
+	if w.compressor != nil {
+		// the headers were switched to a chunked, compressed body
+		n, err := w.compressor.Write(p)
+		if err != nil {
+			return n, err
+		}
+		// the body is complete, so end the message right away
+		w.writerState = WriterStateTrailersWritten
+		err = w.closeCompressor()
+		if err != nil || w.noChunking {
+			return n, err
+		}
+		_, err = w.writer.Write([]byte("0\r\n\r\n"))
+		return n, err
+	}
 	return w.writer.Write(p)
 }
 
@@ -108,6 +651,23 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.writerState != WriterStateHeadersWritten {
 		return 0, fmt.Errorf("headers not written")
 	}
+	if w.omitBody {
+		return len(p), nil
+	}
+	if len(p) == 0 {
+		// an empty chunk would end the body
+		return 0, nil
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(p)
+	}
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	if w.noChunking {
+		return w.writer.Write(p)
+	}
 	n, err := fmt.Fprintf(w.writer, "%X\r\n", len(p))
 	if err != nil {
 		return n, err
@@ -117,7 +677,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return n + m, err
 	}
 	l, err := w.writer.Write([]byte("\r\n"))
-	return n + m + l, nil
+	return n + m + l, err
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
@@ -125,13 +685,47 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, fmt.Errorf("headers not written")
 	}
 	w.writerState = WriterStateBodyWritten
+	if w.omitBody {
+		return 0, nil
+	}
+	err := w.closeCompressor()
+	if err != nil || w.noChunking {
+		return 0, err
+	}
 	return w.writer.Write([]byte("0\r\n"))
 }
 
+// closeCompressor writes out whatever the compressor still holds.
+func (w *Writer) closeCompressor() error {
+	if w.compressor == nil {
+		return nil
+	}
+	err := w.compressor.Close()
+	w.compressor = nil
+	return err
+}
+
+// WriteTrailers ends a chunked body with the trailer fields in h, each of
+// which has to be declared in the Trailer header of the response. Finish
+// calls it without trailers if the handler does not.
 func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.writerState != WriterStateBodyWritten {
 		return fmt.Errorf("body not written")
 	}
+	if len(h) > 0 && !w.chunked {
+		return fmt.Errorf("trailers require a chunked body")
+	}
+	for key := range h {
+		if forbiddenTrailers[key] {
+			return fmt.Errorf("%w: %s", ErrForbiddenTrailer, key)
+		}
+		if !w.trailers[key] {
+			return fmt.Errorf("%w: %s", ErrUndeclaredTrailer, key)
+		}
+	}
 	w.writerState = WriterStateTrailersWritten
+	if w.omitBody || w.noChunking {
+		return nil
+	}
 	return WriteHeaders(w.writer, h)
 }
@@ -0,0 +1,633 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roerd/httpfromtcp/internal/cookie"
+	"github.com/roerd/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterFraming(t *testing.T) {
+	// Test: Small body gets a Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Header().Set("Content-Type", "text/html")
+	_, err := w.Write([]byte("<h1>"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hi</h1>"))
+	require.NoError(t, err)
+	assert.NotContains(t, buf.String(), "<h1>")
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.Contains(t, out, "content-type: text/html\r\n")
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n<h1>hi</h1>"))
+
+	// Test: Large body switches to chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(404))
+	big := bytes.Repeat([]byte("a"), maxBufferedBody+1)
+	_, err = w.Write(big)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("tail"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out, "content-length")
+	assert.Contains(t, out, "\r\n\r\n1001\r\n"+string(big)+"\r\n4\r\ntail\r\n0\r\n\r\n")
+
+	// Test: Nothing written
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-length: 0\r\n")
+	assert.NotContains(t, out, "content-type")
+
+	// Test: Explicit chunked headers frame Write calls as chunks
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	h := GetNewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+
+	// Test: Empty writes don't end a chunked body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte("a"))
+	require.NoError(t, err)
+	n, err := w.Write(nil)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	_, err = w.WriteChunkedBody([]byte{})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n1\r\na\r\n1\r\nb\r\n0\r\n\r\n"), "%q", buf.String())
+
+	// Test: No framing headers for statuses without a body
+	for _, status := range []StatusCode{101, 204, 304} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		require.NoError(t, w.WriteStatusLine(status))
+		_, err = w.Write([]byte("body"))
+		assert.Error(t, err, status)
+		require.NoError(t, w.Finish())
+		out = buf.String()
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 "+strconv.Itoa(int(status))+" "+status.String()+"\r\n"), out)
+		assert.NotContains(t, out, "content-length", status)
+		assert.NotContains(t, out, "content-type", status)
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\n"), status)
+	}
+
+	// Test: Body is omitted but Content-Length kept
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.OmitBody()
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.Contains(t, out, "content-length: 5\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Buffer.Write(p)
+}
+
+func TestWriterCoalescesWrites(t *testing.T) {
+	// Test: Status line, headers and small body in one write
+	cw := &countingWriter{}
+	w := NewWriter(cw)
+	require.NoError(t, w.WriteStatusLine(200))
+	body := []byte("hello world")
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body), "text/plain")))
+	_, err := w.WriteBody(body)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cw.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, cw.writes)
+	assert.True(t, strings.HasSuffix(cw.String(), "\r\n\r\nhello world"))
+
+	// Test: Explicit flush while streaming
+	cw = &countingWriter{}
+	w = NewWriter(cw)
+	require.NoError(t, w.WriteStatusLine(200))
+	h := GetNewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("first"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 1, cw.writes)
+	assert.True(t, strings.HasSuffix(cw.String(), "5\r\nfirst\r\n"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 2, cw.writes)
+
+	// Test: Flush without explicit headers switches to chunked
+	cw = &countingWriter{}
+	w = NewWriter(cw)
+	_, err = io.WriteString(w, "progress 1\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Contains(t, cw.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(cw.String(), "\r\n\r\nB\r\nprogress 1\n\r\n"), "%q", cw.String())
+	_, err = io.WriteString(w, "progress 2\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(cw.String(), "B\r\nprogress 2\n\r\n0\r\n\r\n"), "%q", cw.String())
+	assert.NotContains(t, cw.String(), "content-length")
+
+	// Test: Writer is unusable after Finish
+	require.Error(t, w.Flush())
+	_, err = w.Write([]byte("late"))
+	require.Error(t, err)
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	path := filepath.Join(t.TempDir(), "body.txt")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+
+	// Test: File over a TCP connection gets a Content-Length
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	w := NewWriter(conn)
+	n, err := w.ReadFrom(file)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)-10), n)
+	require.NoError(t, w.Finish())
+	conn.Close()
+	out := string(<-received)
+	assert.Contains(t, out, "content-length: 9990\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+string(content[10:])))
+
+	// Test: Non-file source is copied through Write
+	var buf bytes.Buffer
+	w = NewWriter(&buf)
+	n, err = w.ReadFrom(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+
+	// Test: Body is not read for HEAD requests
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.OmitBody()
+	n, err = w.ReadFrom(file)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.Contains(t, out, "content-length: 10000\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate, br"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0.5, deflate"))
+	assert.Equal(t, "deflate", negotiateEncoding("deflate, gzip;q=0"))
+	assert.Equal(t, "gzip", negotiateEncoding("*"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0, *;q=0.1"))
+	assert.Equal(t, "", negotiateEncoding("br, identity"))
+	assert.Equal(t, "", negotiateEncoding(""))
+}
+
+func TestWriterCompression(t *testing.T) {
+	body := strings.Repeat("compress me please ", 100)
+
+	// Test: Buffered body gets a recomputed Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.EnableCompression("gzip")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	head, compressed, found := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, found)
+	head += "\r\n"
+	assert.Contains(t, head, "content-encoding: gzip\r\n")
+	assert.Contains(t, head, "vary: Accept-Encoding\r\n")
+	assert.Contains(t, head, "content-length: "+strconv.Itoa(len(compressed))+"\r\n")
+	reader, err := gzip.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(decompressed))
+
+	// Test: Explicit Content-Length is switched to chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableCompression("deflate")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body), "application/json")))
+	_, err = w.WriteBody([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	head, _, _ = strings.Cut(buf.String(), "\r\n\r\n")
+	head += "\r\n"
+	assert.Contains(t, head, "content-encoding: deflate\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n0\r\n\r\n"))
+
+	// Test: Already compressed types are left alone
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableCompression("gzip")
+	w.Header().Set("Content-Type", "video/mp4")
+	_, err = w.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "content-encoding")
+	assert.NotContains(t, buf.String(), "vary")
+	assert.True(t, strings.HasSuffix(buf.String(), body))
+
+	// Test: Client without gzip support still gets Vary
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableCompression("identity")
+	_, err = w.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "content-encoding")
+	assert.Contains(t, buf.String(), "vary: Accept-Encoding\r\n")
+
+	// Test: Body too small to compress still gets Vary
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableCompression("gzip")
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(`{"ok":true}`))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "content-encoding")
+	assert.Contains(t, buf.String(), "vary: Accept-Encoding\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), `{"ok":true}`))
+
+	// Test: Streamed body for a client without gzip support gets Vary
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableCompression("br")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body), "text/plain")))
+	_, err = w.WriteBody([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "content-encoding")
+	assert.Contains(t, buf.String(), "vary: Accept-Encoding\r\n")
+}
+
+func TestWriterSetCookie(t *testing.T) {
+	// Test: Each cookie gets a header line of its own
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "session", Value: "abc123", Path: "/", HttpOnly: true}))
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "theme", Value: "dark"}))
+	_, err := w.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.Contains(t, out, "\r\nset-cookie: session=abc123; Path=/; HttpOnly\r\n")
+	assert.Contains(t, out, "\r\nset-cookie: theme=dark\r\n")
+
+	// Test: Cookies are sent with explicit headers too
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "a", Value: "1"}))
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0, "text/plain")))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "\r\nset-cookie: a=1\r\n")
+
+	// Test: Invalid cookie
+	err = NewWriter(&buf).SetCookie(&cookie.Cookie{Name: "a", Value: "x;y"})
+	assert.ErrorIs(t, err, cookie.ErrInvalidCookie)
+
+	// Test: Too late once the headers are out
+	err = w.SetCookie(&cookie.Cookie{Name: "b", Value: "2"})
+	assert.Error(t, err)
+}
+
+func TestWriteJSON(t *testing.T) {
+	// Test: Value with status and Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteJSON(201, map[string]any{"id": 7}))
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, out, "content-type: application/json\r\n")
+	assert.Contains(t, out, "content-length: 9\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n{\"id\":7}\n"))
+
+	// Test: Values that cannot be encoded leave the writer untouched
+	buf.Reset()
+	w = NewWriter(&buf)
+	assert.Error(t, w.WriteJSON(200, make(chan int)))
+	require.NoError(t, w.WriteStatusLine(500))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+}
+
+func TestJSONArray(t *testing.T) {
+	// Test: Small array gets a Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	a, err := w.StartJSONArray(200)
+	require.NoError(t, err)
+	require.NoError(t, a.Encode(1))
+	require.NoError(t, a.Encode("two"))
+	require.NoError(t, a.Close())
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.Contains(t, out, "content-type: application/json\r\n")
+	assert.Contains(t, out, "content-length: 10\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n[1,\"two\"]\n"))
+
+	// Test: Large array is streamed chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	a, err = w.StartJSONArray(200)
+	require.NoError(t, err)
+	for i := range 2000 {
+		require.NoError(t, a.Encode(i))
+	}
+	require.NoError(t, a.Close())
+	require.NoError(t, w.Finish())
+	out = buf.String()
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	_, body, _ := strings.Cut(out, "\r\n\r\n")
+	decoded, err := io.ReadAll(httputil.NewChunkedReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	var values []int
+	require.NoError(t, json.Unmarshal(decoded, &values))
+	assert.Len(t, values, 2000)
+	assert.Equal(t, 1999, values[1999])
+}
+
+func TestWriterDisableChunking(t *testing.T) {
+	// Test: Large body is sent as it is and delimited by closing
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.DisableChunking()
+	big := bytes.Repeat([]byte("a"), maxBufferedBody+1)
+	_, err := w.Write(big)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("tail"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	head, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	head += "\r\n"
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, head, "transfer-encoding")
+	assert.NotContains(t, head, "content-length")
+	assert.Contains(t, head, "connection: close\r\n")
+	assert.Equal(t, string(big)+"tail", body)
+
+	// Test: Explicit chunked headers and trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.DisableChunking()
+	require.NoError(t, w.WriteStatusLine(200))
+	h := GetNewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := GetNewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+	assert.NotContains(t, buf.String(), "x-checksum")
+}
+
+func TestWriterInformational(t *testing.T) {
+	// Test: Interim responses go out right away, before the final one
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := GetNewHeaders()
+	h.Set("Link", "</style.css>; rel=preload")
+	require.NoError(t, w.WriteInformational(103, h))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload\r\n\r\n", buf.String())
+	require.NoError(t, w.WriteStatusLine(200))
+	assert.Error(t, w.WriteInformational(100, nil))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "\r\n\r\nHTTP/1.1 200 OK\r\n")
+
+	// Test: Nothing for HTTP/1.0 clients
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.DisableChunking()
+	require.NoError(t, w.WriteInformational(103, h))
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestWriterPreempt(t *testing.T) {
+	// Test: Preempting before the status line
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := GetDefaultHeaders(4, "text/plain")
+	assert.True(t, w.Preempt(503, h, []byte("busy")))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nbusy"))
+	_, err := w.Write([]byte("late"))
+	assert.ErrorIs(t, err, ErrPreempted)
+	assert.ErrorIs(t, w.WriteInformational(100, nil), ErrPreempted)
+	assert.False(t, w.Preempt(503, h, []byte("again")))
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "late")
+
+	// Test: Too late once the status line is written
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	assert.False(t, w.Preempt(503, h, []byte("busy")))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Too late once the handler hijacked the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableHijack(func() (net.Conn, *bufio.Reader, error) {
+		return nil, bufio.NewReader(strings.NewReader("")), nil
+	})
+	_, _, err = w.Hijack()
+	require.NoError(t, err)
+	assert.False(t, w.Preempt(503, h, []byte("busy")))
+	assert.Empty(t, buf.String())
+}
+
+func TestWriterHijack(t *testing.T) {
+	hijackFunc := func() (net.Conn, *bufio.Reader, error) {
+		return nil, bufio.NewReader(strings.NewReader("pending")), nil
+	}
+
+	// Test: Not available unless the server enables it
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	// Test: Status line and headers are sent before handing over
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableHijack(hijackFunc)
+	require.NoError(t, w.WriteStatusLine(101))
+	w.Header().Set("Upgrade", "websocket")
+	_, rw, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nupgrade: websocket\r\n\r\n", buf.String())
+	pending, err := io.ReadAll(rw)
+	require.NoError(t, err)
+	assert.Equal(t, "pending", string(pending))
+
+	// Test: The writer cannot be used afterwards
+	_, err = w.Write([]byte("late"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	assert.ErrorIs(t, w.Flush(), ErrHijacked)
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "late")
+
+	// Test: Nothing is written if the handler didn't write anything
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.EnableHijack(hijackFunc)
+	_, _, err = w.Hijack()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Empty(t, buf.String())
+}
+
+func TestWriterTrailers(t *testing.T) {
+	chunkedHeaders := func(trailer string) headers.Headers {
+		h := GetNewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		if trailer != "" {
+			h.Set("Trailer", trailer)
+		}
+		return h
+	}
+
+	// Test: Declared trailers are sent after the last chunk
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Checksum, X-Length")))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := GetNewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n5\r\nhello\r\n0\r\nx-checksum: abc\r\n\r\n"), "%q", buf.String())
+
+	// Test: Undeclared and forbidden trailers are rejected
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Checksum")))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers = GetNewHeaders()
+	trailers.Set("X-Other", "abc")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), ErrUndeclaredTrailer)
+	trailers = GetNewHeaders()
+	trailers.Set("Content-Length", "5")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), ErrForbiddenTrailer)
+
+	// Test: Message is terminated by Finish without WriteTrailers
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\n\r\n"), "%q", buf.String())
+	_, err = io.ReadAll(httputil.NewChunkedReader(strings.NewReader(strings.SplitN(buf.String(), "\r\n\r\n", 2)[1])))
+	assert.NoError(t, err)
+
+	// Test: Forbidden fields cannot be declared
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	assert.ErrorIs(t, w.WriteHeaders(chunkedHeaders("X-Checksum, Content-Type")), ErrForbiddenTrailer)
+
+	// Test: No trailers for a body with a Content-Length
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(200))
+	h := GetDefaultHeaders(5, "text/plain")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	trailers = GetNewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	assert.Error(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+}
@@ -0,0 +1,64 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUndeclaredTrailer = errors.New("trailer field not declared in Trailer header")
+	ErrForbiddenTrailer  = errors.New("field not allowed in trailers")
+)
+
+// forbiddenTrailers are fields a recipient needs before the body, or that
+// control framing, routing or authentication, and so must not be sent as
+// trailers (RFC 9110, section 6.5.1).
+var forbiddenTrailers = map[string]bool{
+	"age":                 true,
+	"authorization":       true,
+	"cache-control":       true,
+	"connection":          true,
+	"content-encoding":    true,
+	"content-length":      true,
+	"content-range":       true,
+	"content-type":        true,
+	"date":                true,
+	"expect":              true,
+	"expires":             true,
+	"host":                true,
+	"keep-alive":          true,
+	"location":            true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"range":               true,
+	"retry-after":         true,
+	"set-cookie":          true,
+	"te":                  true,
+	"trailer":             true,
+	"transfer-encoding":   true,
+	"vary":                true,
+	"www-authenticate":    true,
+}
+
+// declaredTrailers parses the value of a Trailer header into the set of
+// lowercased field names it announces.
+func declaredTrailers(value string) (map[string]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	trailers := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if forbiddenTrailers[name] {
+			return nil, fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+		}
+		trailers[name] = true
+	}
+	return trailers, nil
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+)
+
+// HandlerError describes an error response in the terms of RFC 9457
+// (Problem Details for HTTP APIs). Depending on the request's Accept header
+// it is sent as application/problem+json, as an HTML page or as plain text.
+type HandlerError struct {
+	StatusCode response.StatusCode
+	// Type is a URI identifying the kind of problem. Empty means
+	// "about:blank", i.e. the problem is just what the status code says.
+	Type string
+	// Title is a short summary of the problem type. It defaults to the
+	// reason phrase of the status code.
+	Title string
+	// Detail explains this occurrence of the problem.
+	Detail string
+	// Instance is a URI identifying this occurrence of the problem.
+	Instance string
+	// Header holds additional headers for the response, such as Allow for
+	// a 405 or Retry-After for a 503.
+	Header headers.Headers
+}
+
+func (herr *HandlerError) Error() string {
+	problem := herr.problemDetails()
+	if problem.Detail == "" {
+		return strconv.Itoa(problem.Status) + " " + problem.Title
+	}
+	return strconv.Itoa(problem.Status) + " " + problem.Title + ": " + problem.Detail
+}
+
+// problemDetails holds the members of a problem details object. It is both
+// what gets encoded as JSON and the data for error page templates.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title,omitempty"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func (herr *HandlerError) problemDetails() problemDetails {
+	problem := problemDetails{
+		Type:     herr.Type,
+		Title:    herr.Title,
+		Status:   int(herr.StatusCode),
+		Detail:   herr.Detail,
+		Instance: herr.Instance,
+	}
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+	if problem.Title == "" {
+		problem.Title = herr.StatusCode.String()
+	}
+	return problem
+}
+
+const (
+	contentTypeProblem = "application/problem+json"
+	contentTypeHTML    = "text/html; charset=utf-8"
+	contentTypePlain   = "text/plain; charset=utf-8"
+)
+
+// Write sends the error as a plain text response directly to w. It is meant
+// for errors that happen before a response.Writer can be used, such as a
+// request that could not be parsed.
+func (herr *HandlerError) Write(w io.Writer) error {
+	body := herr.render(contentTypePlain)
+	err := response.WriteStatusLine(w, herr.StatusCode)
+	if err != nil {
+		return err
+	}
+	err = response.WriteHeaders(w, herr.headers(len(body), contentTypePlain))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// WriteResponse sends the error in the format the request's Accept header
+// prefers, using the server's error pages (see WithErrorPages). req may be
+// nil, in which case it is sent as plain text.
+func (herr *HandlerError) WriteResponse(w *response.Writer, req *request.Request) error {
+	return requestErrorPages(req).Write(w, req, herr)
+}
+
+func (herr *HandlerError) headers(contentLength int, contentType string) headers.Headers {
+	h := response.GetDefaultHeaders(contentLength, contentType)
+	for key, value := range herr.Header {
+		h.Set(key, value)
+	}
+	return h
+}
+
+// render returns the body of the error for one of the content types
+// negotiateErrorType picks.
+func (herr *HandlerError) render(contentType string) []byte {
+	problem := herr.problemDetails()
+	switch contentType {
+	case contentTypeProblem:
+		body, _ := json.Marshal(problem)
+		return append(body, '\n')
+	case contentTypeHTML:
+		var buf bytes.Buffer
+		defaultErrorPage.Execute(&buf, problem)
+		return buf.Bytes()
+	default:
+		if problem.Detail != "" {
+			return []byte(problem.Detail + "\n")
+		}
+		return []byte(problem.Title + "\n")
+	}
+}
+
+var defaultErrorPage = template.Must(template.New("error").Parse(`<html>
+  <head>
+    <title>{{.Status}} {{.Title}}</title>
+  </head>
+  <body>
+    <h1>{{.Title}}</h1>
+    {{- with .Detail}}
+    <p>{{.}}</p>
+    {{- end}}
+  </body>
+</html>
+`))
+
+// ErrorPages maps status codes to templates for the HTML version of error
+// responses. The templates are executed with the members of the problem
+// details object as data: .Type, .Title, .Status, .Detail and .Instance,
+// with Type and Title filled in if the HandlerError left them empty.
+type ErrorPages map[response.StatusCode]*template.Template
+
+// WithErrorPages makes the server use the given templates for the HTML
+// version of error responses: the ones it generates itself, e.g. for a body
+// that is too large, and the ones sent with HandlerError.WriteResponse,
+// WriteError, TimeoutHandler, Router and VirtualHosts.
+func WithErrorPages(pages ErrorPages) Option {
+	return func(s *Server) {
+		s.errorPages = pages
+	}
+}
+
+type errorPagesKey struct{}
+
+// requestErrorPages returns the error pages of the server that req came
+// through, or nil if it has none.
+func requestErrorPages(req *request.Request) ErrorPages {
+	if req == nil {
+		return nil
+	}
+	pages, _ := req.Context().Value(errorPagesKey{}).(ErrorPages)
+	return pages
+}
+
+// Write sends herr in the format the request's Accept header prefers, using
+// the template for its status code if it is to be HTML and there is one.
+// req may be nil, in which case it is sent as plain text.
+func (p ErrorPages) Write(w *response.Writer, req *request.Request, herr *HandlerError) error {
+	h, body := p.response(req, herr)
+	err := w.WriteStatusLine(herr.StatusCode)
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+// response returns the headers and body Write sends for herr.
+func (p ErrorPages) response(req *request.Request, herr *HandlerError) (headers.Headers, []byte) {
+	contentType := contentTypePlain
+	if req != nil {
+		contentType = negotiateErrorType(req.Headers.Get("Accept"))
+	}
+
+	var body []byte
+	if tmpl, ok := p[herr.StatusCode]; ok && contentType == contentTypeHTML {
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, herr.problemDetails())
+		if err != nil {
+			log.Printf("error executing error page for %d: %v\n", herr.StatusCode, err)
+		} else {
+			body = buf.Bytes()
+		}
+	}
+	if body == nil {
+		body = herr.render(contentType)
+	}
+
+	h := herr.headers(len(body), contentType)
+	if req != nil {
+		h.Set("Vary", "Accept")
+	}
+	return h, body
+}
+
+// negotiateErrorType picks the content type for an error response from an
+// Accept header. Clients that don't state a preference for one of the
+// supported types, e.g. with "*/*" or no Accept header at all, get plain
+// text.
+func negotiateErrorType(accept string) string {
+	type preference struct {
+		q        float64
+		explicit bool
+	}
+	candidates := []struct {
+		contentType string
+		mediaTypes  []string
+	}{
+		{contentTypeProblem, []string{"application/problem+json", "application/json"}},
+		{contentTypeHTML, []string{"text/html"}},
+		{contentTypePlain, []string{"text/plain"}},
+	}
+
+	best, bestPref := contentTypePlain, preference{}
+	for _, candidate := range candidates {
+		var pref preference
+		specificity := -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaRange, params, _ := strings.Cut(part, ";")
+			mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+			s := matchMediaRange(mediaRange, candidate.mediaTypes)
+			if s < 0 || s < specificity {
+				continue
+			}
+			specificity = s
+			pref = preference{q: parseQValue(params), explicit: s == 2}
+		}
+		if pref.explicit && pref.q > 0 && (!bestPref.explicit || pref.q > bestPref.q) {
+			best, bestPref = candidate.contentType, pref
+		}
+	}
+	return best
+}
+
+// matchMediaRange returns how specifically mediaRange matches one of
+// mediaTypes: 2 for an exact match, 1 for "type/*", 0 for "*/*" and -1 if it
+// does not match at all.
+func matchMediaRange(mediaRange string, mediaTypes []string) int {
+	if mediaRange == "*/*" {
+		return 0
+	}
+	for _, mediaType := range mediaTypes {
+		if mediaRange == mediaType {
+			return 2
+		}
+	}
+	if prefix, ok := strings.CutSuffix(mediaRange, "*"); ok && strings.HasPrefix(mediaTypes[0], prefix) {
+		return 1
+	}
+	return -1
+}
+
+func parseQValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(strings.TrimSpace(name), "q") {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return 0
+			}
+			return q
+		}
+	}
+	return 1
+}
+
+// WriteError responds to an error returned by the request package, e.g. by
+// Request.ParseForm or Request.DecodeBody, with the matching status code.
+// A *HandlerError is sent as it is.
+func WriteError(w *response.Writer, req *request.Request, err error) error {
+	var hErr *HandlerError
+	if !errors.As(err, &hErr) {
+		hErr = &HandlerError{
+			StatusCode: errorStatus(err),
+			Detail:     err.Error(),
+		}
+	}
+	return hErr.WriteResponse(w, req)
+}
+
+// errorStatus picks the status code for an error returned by the request
+// package.
+func errorStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrTimeout):
+		return 408
+	case errors.Is(err, request.ErrBodyTooLarge), errors.Is(err, request.ErrTooManyParts):
+		return 413
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return 431
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return 505
+	case errors.Is(err, request.ErrUnsupportedContentEncoding), errors.Is(err, request.ErrNotMultipart),
+		errors.Is(err, request.ErrNotJSON):
+		return 415
+	default:
+		return 400
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateErrorType(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                         contentTypePlain,
+		"*/*":                      contentTypePlain,
+		"application/json":         contentTypeProblem,
+		"application/problem+json": contentTypeProblem,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": contentTypeHTML,
+		"text/html;q=0.5, application/json":                               contentTypeProblem,
+		"text/html;q=0, */*":                                              contentTypePlain,
+		"TEXT/PLAIN, text/html;q=0.9":                                     contentTypePlain,
+		"image/png":                                                       contentTypePlain,
+	} {
+		assert.Equal(t, expected, negotiateErrorType(accept), "Accept: %s", accept)
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	hErr := &HandlerError{
+		StatusCode: 404,
+		Type:       "https://example.com/probs/no-coffee",
+		Detail:     "we're out of <coffee>",
+		Instance:   "/coffee/42",
+	}
+	respond := func(accept string) string {
+		headers := "Host: localhost\r\n"
+		if accept != "" {
+			headers += "Accept: " + accept + "\r\n"
+		}
+		return dispatch(t, func(w *response.Writer, req *request.Request) {
+			require.NoError(t, hErr.WriteResponse(w, req))
+		}, "GET /coffee/42 HTTP/1.1\r\n"+headers+"\r\n")
+	}
+
+	// Test: problem+json
+	out := respond("application/json")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	assert.Contains(t, out, "vary: Accept\r\n")
+	_, body, _ := strings.Cut(out, "\r\n\r\n")
+	var problem map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &problem))
+	assert.Equal(t, map[string]any{
+		"type":     "https://example.com/probs/no-coffee",
+		"title":    "Not Found",
+		"status":   404.0,
+		"detail":   "we're out of <coffee>",
+		"instance": "/coffee/42",
+	}, problem)
+
+	// Test: HTML escapes the detail
+	out = respond("text/html")
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, out, "<title>404 Not Found</title>")
+	assert.Contains(t, out, "<p>we&#39;re out of &lt;coffee&gt;</p>")
+
+	// Test: Plain text by default
+	out = respond("")
+	assert.Contains(t, out, "content-type: text/plain; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nwe're out of <coffee>\n"))
+
+	// Test: Custom page for the status code
+	pages := ErrorPages{404: template.Must(template.New("404").Parse("<h1>{{.Status}}: {{.Title}}</h1>"))}
+	out = dispatch(t, func(w *response.Writer, req *request.Request) {
+		require.NoError(t, pages.Write(w, req, hErr))
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: text/html\r\n\r\n")
+	assert.Contains(t, out, "content-length: 23\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n<h1>404: Not Found</h1>"))
+}
+
+func TestHandlerErrorWrite(t *testing.T) {
+	// Test: Content-Length matches the body
+	var buf bytes.Buffer
+	hErr := &HandlerError{StatusCode: 400, Detail: "invalid request line"}
+	require.NoError(t, hErr.Write(&buf))
+	head, body, found := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, found)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, head+"\r\n", "content-length: 21\r\n")
+	assert.Equal(t, "invalid request line\n", body)
+}
+
+func TestWriteError(t *testing.T) {
+	// Test: Request package errors map to status codes
+	out := dispatch(t, func(w *response.Writer, req *request.Request) {
+		WriteError(w, req, request.ErrNotJSON)
+	}, "POST / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+
+	// Test: HandlerErrors are sent as they are
+	out = dispatch(t, func(w *response.Writer, req *request.Request) {
+		err := errors.Join(errors.New("lookup failed"), &HandlerError{StatusCode: 421})
+		WriteError(w, req, err)
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 421 Misdirected Request\r\n"))
+}
+
+func TestServerErrorPages(t *testing.T) {
+	// Test: Server generated errors use the configured pages
+	pages := ErrorPages{413: template.Must(template.New("413").Parse("<p>{{.Detail}}</p>"))}
+	conn := startServer(t, echoBody, WithMaxBodySize(4), WithErrorPages(pages))
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nAccept: text/html\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\n<p>request body larger than 4 bytes</p>"))
+
+	pages = ErrorPages{
+		404: template.Must(template.New("404").Parse("<p>server 404</p>")),
+		415: template.Must(template.New("415").Parse("<p>server 415</p>")),
+		503: template.Must(template.New("503").Parse("<p>server 503</p>")),
+	}
+	serve := func(handler Handler, target string) string {
+		conn := startServer(t, handler, WithErrorPages(pages))
+		_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\nAccept: text/html\r\n\r\n")
+		require.NoError(t, err)
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// Test: Errors sent by handlers use the server's pages
+	page := serve(func(w *response.Writer, req *request.Request) {
+		WriteError(w, req, request.ErrNotJSON)
+	}, "/")
+	assert.True(t, strings.HasSuffix(page, "\r\n\r\n<p>server 415</p>"), page)
+
+	// Test: Router and TimeoutHandler use the server's pages
+	rt := NewRouter()
+	rt.Handle(request.MethodGet, "/slow", TimeoutHandler(func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	}, 10*time.Millisecond, nil))
+	page = serve(rt.Dispatch, "/missing")
+	assert.True(t, strings.HasSuffix(page, "\r\n\r\n<p>server 404</p>"), page)
+	page = serve(rt.Dispatch, "/slow")
+	assert.True(t, strings.HasSuffix(page, "\r\n\r\n<p>server 503</p>"), page)
+
+	// Test: Router pages replace the server's
+	rt.ErrorPages = ErrorPages{404: template.Must(template.New("404").Parse("<p>router 404</p>"))}
+	page = serve(rt.Dispatch, "/missing")
+	assert.True(t, strings.HasSuffix(page, "\r\n\r\n<p>router 404</p>"), page)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+)
+
+// Compress wraps handler so that its responses are compressed with gzip or
+// deflate when the client's Accept-Encoding allows it and the content type
+// is worth compressing.
+func Compress(handler Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.EnableCompression(req.Headers.Get("Accept-Encoding"))
+		handler(w, req)
+	}
+}
+
+// DecodeBody wraps handler so that it sees request bodies with their
+// Content-Encoding (gzip, deflate) already undone. Requests whose decoded
+// body would exceed maxSize bytes are rejected with a 413, ones using an
+// unknown coding with a 415 and corrupt ones with a 400.
+func DecodeBody(handler Handler, maxSize int) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		err := req.DecodeBody(maxSize)
+		if err != nil {
+			WriteError(w, req, err)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// TimeoutHandler wraps handler so that it runs with a context that is
+// cancelled after timeout. If the handler has not written the status line by
+// then, the client gets herr instead, or a plain 503 Service Unavailable if
+// herr is nil, and everything the handler writes afterwards fails with
+// response.ErrPreempted. A handler that already started its response is
+// waited for; it should give up once the context is done.
+func TimeoutHandler(handler Handler, timeout time.Duration, herr *HandlerError) Handler {
+	if herr == nil {
+		herr = &HandlerError{
+			StatusCode: 503,
+			Detail:     "the request took too long",
+		}
+	}
+	return func(w *response.Writer, req *request.Request) {
+		ctx, cancel := context.WithTimeoutCause(req.Context(), timeout, ErrHandlerTimeout)
+		defer cancel()
+
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+				close(done)
+			}()
+			handler(w, req.WithContext(ctx))
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			h, body := requestErrorPages(req).response(req, herr)
+			if w.Preempt(herr.StatusCode, h, body) {
+				// the handler may still be running, but it can no longer
+				// write anything
+				return
+			}
+			<-done
+		}
+		select {
+		case p := <-panicked:
+			// let it crash the way it would have without the timeout
+			panic(p)
+		default:
+		}
+	}
+}
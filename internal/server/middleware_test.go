@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	// Test: Fast handler is not affected
+	out := dispatch(t, TimeoutHandler(func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, "fast")
+	}, time.Second, nil), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nfast"))
+
+	// Test: Slow handler is preempted and cannot write afterwards
+	lateErr := make(chan error, 1)
+	slow := func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		assert.ErrorIs(t, context.Cause(req.Context()), ErrHandlerTimeout)
+		time.Sleep(10 * time.Millisecond)
+		_, err := io.WriteString(w, "too late")
+		lateErr <- err
+	}
+	conn := startServer(t, TimeoutHandler(slow, 20*time.Millisecond, &HandlerError{
+		StatusCode: 503,
+		Detail:     "coffee machine is warming up",
+		Header:     headers.Headers{"retry-after": "5"},
+	}))
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n")
+	require.NoError(t, err)
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, string(rest), "retry-after: 5\r\n")
+	assert.Contains(t, string(rest), "content-type: application/problem+json\r\n")
+	assert.Contains(t, string(rest), `"detail":"coffee machine is warming up"`)
+	assert.NotContains(t, string(rest), "too late")
+	assert.ErrorIs(t, <-lateErr, response.ErrPreempted)
+
+	// Test: Handler that already started its response is waited for
+	out = dispatch(t, TimeoutHandler(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(200)
+		<-req.Context().Done()
+		io.WriteString(w, "partial")
+	}, 10*time.Millisecond, nil), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\npartial"))
+
+	// Test: Panics reach the caller
+	assert.PanicsWithValue(t, "boom", func() {
+		dispatch(t, TimeoutHandler(func(w *response.Writer, req *request.Request) {
+			panic("boom")
+		}, time.Second, nil), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	})
+}
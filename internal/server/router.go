@@ -0,0 +1,151 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+)
+
+// Router dispatches requests by method and path. A pattern ending in "/"
+// matches every path below it, with the longest matching pattern winning;
+// any other pattern only matches that exact path.
+//
+// Requests whose method is not registered on any route get a 501 Not
+// Implemented, requests for an unknown path a 404 Not Found, and requests
+// using a method the matched path does not support a 405 Method Not Allowed
+// listing the supported methods in the Allow header.
+//
+// HEAD requests run the GET handler unless a HEAD handler is registered (the
+// server drops the body), and OPTIONS requests are answered with the allowed
+// methods of the path, or of the whole router for "OPTIONS *", unless an
+// OPTIONS handler is registered.
+type Router struct {
+	routes  map[string]map[string]Handler
+	methods map[string]bool
+
+	// ErrorPages, if set, replaces the server's error pages (see
+	// WithErrorPages) for the error responses the router sends.
+	ErrorPages ErrorPages
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes:  make(map[string]map[string]Handler),
+		methods: make(map[string]bool),
+	}
+}
+
+func (rt *Router) Handle(method, pattern string, handler Handler) {
+	if rt.routes[pattern] == nil {
+		rt.routes[pattern] = make(map[string]Handler)
+	}
+	rt.routes[pattern][method] = handler
+	rt.methods[method] = true
+}
+
+func (rt *Router) Dispatch(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if !rt.implements(method) {
+		rt.writeError(w, req, 501, "method not implemented", "")
+		return
+	}
+
+	if method == request.MethodOptions && req.RequestLine.RequestTarget == "*" {
+		rt.writeOptions(w, allowHeader(rt.methods))
+		return
+	}
+
+	handlers := rt.match(req.Path())
+	if handlers == nil {
+		rt.writeError(w, req, 404, "", "")
+		return
+	}
+
+	handler, ok := handlers[method]
+	if !ok && method == request.MethodHead {
+		handler, ok = handlers[request.MethodGet]
+	}
+	if !ok && method == request.MethodOptions {
+		rt.writeOptions(w, allowHeader(handlers))
+		return
+	}
+	if !ok {
+		rt.writeError(w, req, 405, "", allowHeader(handlers))
+		return
+	}
+	handler(w, req)
+}
+
+// implements reports whether any route serves method, including the
+// methods the router answers on its own.
+func (rt *Router) implements(method string) bool {
+	switch method {
+	case request.MethodOptions:
+		return true
+	case request.MethodHead:
+		return rt.methods[request.MethodHead] || rt.methods[request.MethodGet]
+	default:
+		return rt.methods[method]
+	}
+}
+
+func (rt *Router) match(path string) map[string]Handler {
+	if handlers, ok := rt.routes[path]; ok {
+		return handlers
+	}
+
+	var best string
+	for pattern := range rt.routes {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return rt.routes[best]
+}
+
+func (rt *Router) writeOptions(w *response.Writer, allow string) {
+	err := w.WriteStatusLine(200)
+	if err != nil {
+		return
+	}
+	headers := response.GetDefaultHeaders(0, "text/plain")
+	headers.Delete("Content-Type")
+	headers.Set("Allow", allow)
+	w.WriteHeaders(headers)
+}
+
+func (rt *Router) writeError(w *response.Writer, req *request.Request, statusCode response.StatusCode, detail string, allow string) {
+	hErr := &HandlerError{
+		StatusCode: statusCode,
+		Detail:     detail,
+	}
+	if allow != "" {
+		hErr.Header = headers.Headers{"allow": allow}
+	}
+	pages := rt.ErrorPages
+	if pages == nil {
+		pages = requestErrorPages(req)
+	}
+	pages.Write(w, req, hErr)
+}
+
+// allowHeader lists the given methods plus the ones the router answers on
+// their own, in a stable order.
+func allowHeader[T any](methods map[string]T) string {
+	allowed := make([]string, 0, len(methods)+2)
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	if _, ok := methods[request.MethodGet]; ok {
+		allowed = append(allowed, request.MethodHead)
+	}
+	allowed = append(allowed, request.MethodOptions)
+	slices.Sort(allowed)
+	return strings.Join(slices.Compact(allowed), ", ")
+}
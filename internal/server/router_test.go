@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dispatch(t *testing.T, handler Handler, rawRequest string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func TestRouter(t *testing.T) {
+	var matched string
+	handlerFor := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			matched = name
+		}
+	}
+
+	router := NewRouter()
+	router.Handle(request.MethodGet, "/", handlerFor("root"))
+	router.Handle(request.MethodGet, "/coffee", handlerFor("get coffee"))
+	router.Handle(request.MethodPost, "/coffee", handlerFor("post coffee"))
+	router.Handle(request.MethodGet, "/static/", handlerFor("static"))
+
+	// Test: Exact match, ignoring the query string
+	dispatch(t, router.Dispatch, "GET /coffee?size=large HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "get coffee", matched)
+	dispatch(t, router.Dispatch, "POST /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "post coffee", matched)
+
+	// Test: Dot segments cannot bypass routing
+	dispatch(t, router.Dispatch, "GET /static/%2e%2e/coffee HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "get coffee", matched)
+
+	// Test: Longest subtree match
+	dispatch(t, router.Dispatch, "GET /static/css/main.css HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "static", matched)
+	dispatch(t, router.Dispatch, "GET /tea HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "root", matched)
+
+	// Test: Method not allowed for the path
+	out := dispatch(t, router.Dispatch, "POST /static/main.css HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD, OPTIONS\r\n")
+
+	// Test: HEAD falls back to the GET handler
+	dispatch(t, router.Dispatch, "HEAD /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "get coffee", matched)
+
+	// Test: OPTIONS lists the methods allowed for the path
+	out = dispatch(t, router.Dispatch, "OPTIONS /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD, OPTIONS, POST\r\n")
+	assert.Contains(t, out, "content-length: 0\r\n")
+
+	// Test: OPTIONS * lists the methods allowed anywhere
+	router.Handle(request.MethodDelete, "/static/", handlerFor("delete static"))
+	out = dispatch(t, router.Dispatch, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "allow: DELETE, GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: Method not implemented by any route
+	out = dispatch(t, router.Dispatch, "BREW /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented\r\n"))
+
+	// Test: Unknown path
+	router = NewRouter()
+	router.Handle(request.MethodGet, "/coffee", handlerFor("get coffee"))
+	out = dispatch(t, router.Dispatch, "GET /tea HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+}
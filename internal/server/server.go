@@ -1,62 +1,110 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/roerd/httpfromtcp/internal/request"
 	"github.com/roerd/httpfromtcp/internal/response"
 )
 
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	isClosed atomic.Bool
+	listener       net.Listener
+	handler        Handler
+	isClosed       atomic.Bool
+	maxBodySize    int
+	maxHeaderBytes int
+	readTimeout    time.Duration
+	handlerTimeout time.Duration
+	errorPages     ErrorPages
+
+	// ctx is the parent of every request's context, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 }
 
-type Handler func(w *response.Writer, req *request.Request)
+// The causes of a cancelled request context, see request.Request.Context.
+var (
+	ErrClientDisconnected = errors.New("client disconnected")
+	ErrServerClosed       = errors.New("server closed")
+	ErrHandlerTimeout     = errors.New("handler timeout")
+)
 
-type HandlerError struct {
-	StatusCode response.StatusCode
-	Message    string
+type Option func(*Server)
+
+// WithMaxBodySize sets the largest request body the server accepts, in bytes.
+// Requests declaring a larger Content-Length are rejected with a 413 before
+// their body is read.
+func WithMaxBodySize(n int) Option {
+	return func(s *Server) {
+		s.maxBodySize = n
+	}
 }
 
-func (herr *HandlerError) Write(w io.Writer) error {
-	err := response.WriteStatusLine(w, herr.StatusCode)
-	if err != nil {
-		return err
+// WithMaxHeaderBytes sets the largest request line and headers the server
+// accepts, in bytes. Larger requests are rejected with a 431.
+func WithMaxHeaderBytes(n int) Option {
+	return func(s *Server) {
+		s.maxHeaderBytes = n
 	}
-	headers := response.GetDefaultHeaders(len(herr.Message), "text/plain")
-	err = response.WriteHeaders(w, headers)
-	if err != nil {
-		return err
+}
+
+// WithReadTimeout limits the time a client has to send its request,
+// including the body. Slower requests are answered with a 408. For clients
+// waiting for a 100 Continue, the body gets its own limit, starting when the
+// 100 Continue is sent. By default there is no limit.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
 	}
-	_, err = w.Write([]byte("\r\n"))
-	if err != nil {
-		return err
+}
+
+// WithHandlerTimeout cancels the context of a request once its handler has
+// been running for d. Handlers are not stopped, so they have to watch the
+// context to give up. By default there is no limit.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.handlerTimeout = d
 	}
-	_, err = w.Write([]byte(herr.Message))
-	return err
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+type Handler func(w *response.Writer, req *request.Request)
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
 	server := &Server{
-		listener: listener,
-		handler:  handler,
+		listener:       listener,
+		handler:        handler,
+		maxBodySize:    request.DefaultMaxBodyBytes,
+		maxHeaderBytes: request.DefaultMaxHeaderBytes,
+	}
+	server.ctx, server.cancel = context.WithCancelCause(context.Background())
+	for _, opt := range opts {
+		opt(server)
 	}
 	go server.listen()
 	return server, nil
 }
 
+// Close stops accepting connections and cancels the contexts of the requests
+// being handled. It does not wait for their handlers to return.
 func (s *Server) Close() error {
 	s.isClosed.Store(true)
+	s.cancel(ErrServerClosed)
 	return s.listener.Close()
 }
 
@@ -77,19 +125,237 @@ func (s *Server) listen() {
 func (s *Server) handle(conn net.Conn) {
 	log.Printf("handling connection from %s\n", conn.RemoteAddr())
 
-	defer conn.Close()
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
 
-	request, err := request.RequestFromReader(conn)
+	if s.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+	}
+	req, err := request.ReadHeaders(conn,
+		request.WithMaxHeaderBytes(s.maxHeaderBytes),
+		request.WithMaxBodyBytes(s.maxBodySize),
+	)
 	if err != nil {
-		hErr := &HandlerError{
-			StatusCode: 400,
-			Message:    err.Error(),
+		hErr := requestError(conn, err)
+		if hErr != nil {
+			hErr.Write(conn)
 		}
-		hErr.Write(conn)
 		return
 	}
 
 	writer := response.NewWriter(conn)
+	defer func() {
+		err := writer.Finish()
+		if err != nil {
+			log.Printf("error finishing response to %s: %v\n", conn.RemoteAddr(), err)
+		}
+	}()
+	// set up before anything is written, the server's own errors included
+	if req.RequestLine.Method == request.MethodHead {
+		writer.OmitBody()
+	}
+	if !req.RequestLine.ProtoAtLeast(1, 1) {
+		writer.DisableChunking()
+	}
+
+	expectContinue, hErr := s.checkBody(req)
+	if hErr != nil {
+		s.errorPages.Write(writer, req, hErr)
+		return
+	}
+
+	// multipart bodies, which may hold large uploads, are left for the
+	// handler to stream
+	lazyBody := expectContinue || isMultipart(req)
+	if !lazyBody {
+		err = req.ReadBody()
+		if err != nil {
+			hErr := requestError(conn, err)
+			if hErr != nil {
+				s.errorPages.Write(writer, req, hErr)
+			}
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	defer cancel(nil)
+	if s.errorPages != nil {
+		ctx = context.WithValue(ctx, errorPagesKey{}, s.errorPages)
+	}
+	if s.handlerTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, s.handlerTimeout, ErrHandlerTimeout)
+		defer cancelTimeout()
+	}
+	watch := &connWatch{conn: conn, onClose: func() { cancel(ErrClientDisconnected) }}
+	defer watch.stop()
+	req = req.WithContext(ctx)
+	if lazyBody {
+		req.OnReadBody(func() error {
+			// the client sends the body once it gets the 100 Continue,
+			// which only happens if the handler wants the body
+			if expectContinue {
+				err := writer.WriteInformational(100, nil)
+				if err != nil {
+					return err
+				}
+			}
+			if s.readTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+			}
+			return nil
+		}, func(err error) {
+			conn.SetReadDeadline(time.Time{})
+			if err == nil {
+				watch.start()
+			}
+		})
+	} else {
+		watch.start()
+	}
+	writer.EnableHijack(func() (net.Conn, *bufio.Reader, error) {
+		pending := watch.stop()
+		conn.SetReadDeadline(time.Time{})
+		hijacked = true
+		reader := io.MultiReader(bytes.NewReader(req.Buffered()), bytes.NewReader(pending), conn)
+		return conn, bufio.NewReader(reader), nil
+	})
+
+	defer func() {
+		if req.MultipartForm == nil {
+			return
+		}
+		err := req.MultipartForm.RemoveAll()
+		if err != nil {
+			log.Printf("error removing uploaded files of %s: %v\n", conn.RemoteAddr(), err)
+		}
+	}()
+	s.handler(writer, req)
+}
+
+// connWatch runs watchConn for a connection once the request has been read,
+// which for requests waiting for a 100 Continue happens while the handler
+// runs, if at all.
+type connWatch struct {
+	conn    net.Conn
+	onClose func()
+
+	mu       sync.Mutex
+	stopFunc func() []byte
+	stopped  bool
+}
 
-	s.handler(writer, request)
+func (cw *connWatch) start() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.stopped || cw.stopFunc != nil {
+		return
+	}
+	cw.stopFunc = watchConn(cw.conn, cw.onClose)
+}
+
+// stop returns what the client sent after its request, as watchConn's stop
+// does. Once it has been called, start does nothing.
+func (cw *connWatch) stop() []byte {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.stopped = true
+	if cw.stopFunc == nil {
+		return nil
+	}
+	return cw.stopFunc()
+}
+
+// maxPendingBytes is how much of what the client sends after its request
+// watchConn keeps for a handler that hijacks the connection. Once it has that
+// much it stops reading, and with it noticing that the client went away.
+const maxPendingBytes = 64 << 10
+
+// watchConn calls onClose when the client closes the connection, which it
+// notices by reading from conn in the background until stop is called. The
+// request has to be read completely before. stop returns anything the client
+// sent after it, which only matters if the connection gets hijacked, since
+// connections are not reused otherwise. It may be called more than once.
+//
+// Clients that only shut down their sending side while waiting for the
+// response look the same as ones that went away.
+func watchConn(conn net.Conn, onClose func()) (stop func() []byte) {
+	done := make(chan struct{})
+	var pending []byte
+	go func() {
+		defer close(done)
+		buf := make([]byte, 512)
+		for len(pending) < maxPendingBytes {
+			n, err := conn.Read(buf)
+			pending = append(pending, buf[:n]...)
+			if err == nil {
+				continue
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				onClose()
+			}
+			return
+		}
+	}()
+	var once sync.Once
+	return func() []byte {
+		once.Do(func() {
+			// unblock the read
+			conn.SetReadDeadline(time.Now())
+			<-done
+		})
+		return pending
+	}
+}
+
+// requestError returns the response to a request that could not be read,
+// or nil if there is no point in responding because the connection failed.
+func requestError(conn net.Conn, err error) *HandlerError {
+	var pErr *request.ParseError
+	if !errors.As(err, &pErr) {
+		log.Printf("error reading request from %s: %v\n", conn.RemoteAddr(), err)
+		return nil
+	}
+	return &HandlerError{
+		StatusCode: errorStatus(err),
+		Detail:     pErr.Error(),
+	}
+}
+
+// checkBody decides whether the body of a request should be read at all. It
+// rejects bodies above the size limit and unknown expectations, and reports
+// whether the client is waiting for a 100 Continue before sending its body.
+// Expect is ignored for HTTP/1.0 clients, which don't know 1xx responses.
+// isMultipart reports whether req has a multipart/form-data body.
+func isMultipart(req *request.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+func (s *Server) checkBody(req *request.Request) (expectContinue bool, hErr *HandlerError) {
+	if req.ContentLength > s.maxBodySize {
+		return false, &HandlerError{
+			StatusCode: 413,
+			Detail:     fmt.Sprintf("request body larger than %d bytes", s.maxBodySize),
+		}
+	}
+
+	expect, ok := req.Headers["expect"]
+	if !ok || !req.RequestLine.ProtoAtLeast(1, 1) {
+		return false, nil
+	}
+	if !strings.EqualFold(expect, "100-continue") {
+		return false, &HandlerError{
+			StatusCode: 417,
+			Detail:     fmt.Sprintf("unsupported expectation: %q", expect),
+		}
+	}
+	return req.ContentLength > 0, nil
 }
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler, opts ...Option) net.Conn {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func echoBody(w *response.Writer, req *request.Request) {
+	err := req.ReadBody()
+	if err != nil {
+		WriteError(w, req, err)
+		return
+	}
+	w.WriteStatusLine(200)
+	w.WriteHeaders(response.GetDefaultHeaders(len(req.Body), "text/plain"))
+	w.WriteBody(req.Body)
+}
+
+func TestExpectContinue(t *testing.T) {
+	// Test: 100 Continue is sent once the handler reads the body
+	conn := startServer(t, echoBody)
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nhello"))
+
+	// Test: Repeated Content-Length values that agree
+	conn = startServer(t, echoBody)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5, 5\r\n\r\n")
+	require.NoError(t, err)
+	reader = bufio.NewReader(conn)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nhello"))
+
+	// Test: Handler that doesn't read the body causes no 100 Continue
+	conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, "not interested")
+	})
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 200 OK\r\n"), "%q", rest)
+	assert.NotContains(t, string(rest), "100 Continue")
+
+	// Test: Handler that parses a form gets the body after a 100 Continue
+	conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		err := req.ParseForm(1 << 10)
+		if err != nil {
+			WriteError(w, req, err)
+			return
+		}
+		io.WriteString(w, req.PostForm.Get("a"))
+	})
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	reader = bufio.NewReader(conn)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	_, err = io.WriteString(conn, "a=xyz")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "\r\nHTTP/1.1 200 OK\r\n"), "%q", rest)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nxyz"))
+
+	// Test: Body too large is rejected without a 100 Continue
+	conn = startServer(t, echoBody, WithMaxBodySize(4))
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// Test: Unknown expectation
+	conn = startServer(t, echoBody)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 200-ok\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: HTTP/1.0 clients get neither a 100 Continue nor a 417
+	for _, expect := range []string{"100-continue", "200-ok"} {
+		conn = startServer(t, echoBody)
+		_, err = io.WriteString(conn, "POST / HTTP/1.0\r\nExpect: "+expect+"\r\nContent-Length: 5\r\n\r\nhello")
+		require.NoError(t, err)
+		rest, err = io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 200 OK\r\n"), "%s: %q", expect, rest)
+		assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nhello"), expect)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	// Test: The body is streamed to the handler, and spilled files are
+	// removed once it returns
+	var tempFile string
+	conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		err := req.ParseMultipartForm(16)
+		if err != nil {
+			WriteError(w, req, err)
+			return
+		}
+		file, err := req.MultipartForm.File["upload"][0].Open()
+		if err != nil {
+			WriteError(w, req, err)
+			return
+		}
+		defer file.Close()
+		if osFile, ok := file.(*os.File); ok {
+			tempFile = osFile.Name()
+		}
+		fmt.Fprintf(w, "%d body bytes, ", len(req.Body))
+		io.Copy(w, file)
+	})
+	content := strings.Repeat("upload ", 100)
+	body := "--b\r\n" +
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"a.txt\"\r\n" +
+		"\r\n" +
+		content + "\r\n" +
+		"--b--\r\n"
+	_, err := fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 200 OK\r\n"), "%q", rest)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\n0 body bytes, "+content), "%q", rest)
+	require.NotEmpty(t, tempFile)
+	_, err = os.Stat(tempFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request string
+		opts    []Option
+		status  string
+	}{
+		{"Malformed request line", "GET /\r\nHost: localhost\r\n\r\n", nil, "400 Bad Request"},
+		{"Invalid Content-Length", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: five\r\n\r\n", nil, "400 Bad Request"},
+		{"Unsupported version", "GET / HTTP/3.0\r\nHost: localhost\r\n\r\n", nil, "505 HTTP Version Not Supported"},
+		{"Header too large", "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 100) + "\r\n\r\n", []Option{WithMaxHeaderBytes(64)}, "431 Request Header Fields Too Large"},
+		{"Timeout", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nab", []Option{WithReadTimeout(50 * time.Millisecond)}, "408 Request Timeout"},
+	} {
+		conn := startServer(t, echoBody, tc.opts...)
+		_, err := io.WriteString(conn, tc.request)
+		require.NoError(t, err, tc.name)
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err, tc.name)
+		assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 "+tc.status+"\r\n"), "%s: %q", tc.name, out)
+	}
+
+	// Test: Server errors to HEAD requests have no body
+	conn := startServer(t, echoBody, WithMaxBodySize(4))
+	_, err := io.WriteString(conn, "HEAD / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\n"), "%q", out)
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: Response claims HTTP/1.1 and is not chunked
+	big := strings.Repeat("a", 10000)
+	conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, big)
+	})
+	_, err := io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	head, body, _ := strings.Cut(string(out), "\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, head, "transfer-encoding")
+	assert.Equal(t, big, body)
+}
+
+func TestRequestContext(t *testing.T) {
+	started := make(chan struct{}, 1)
+	causes := make(chan error, 1)
+	waitForCancel := func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-req.Context().Done()
+		causes <- context.Cause(req.Context())
+	}
+	waitFor := func(ch <-chan struct{}) {
+		t.Helper()
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("handler did not start")
+		}
+	}
+	cause := func() error {
+		t.Helper()
+		select {
+		case err := <-causes:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("context was not cancelled")
+			return nil
+		}
+	}
+
+	// Test: Client disconnects
+	conn := startServer(t, waitForCancel)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	waitFor(started)
+	require.NoError(t, conn.Close())
+	assert.ErrorIs(t, cause(), ErrClientDisconnected)
+
+	// Test: Handler timeout
+	conn = startServer(t, waitForCancel, WithHandlerTimeout(20*time.Millisecond))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	waitFor(started)
+	assert.ErrorIs(t, cause(), ErrHandlerTimeout)
+
+	// Test: Server is closed
+	s, err := Serve(0, waitForCancel)
+	require.NoError(t, err)
+	conn, err = net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	waitFor(started)
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, cause(), ErrServerClosed)
+
+	// Test: Context is not cancelled while the handler runs normally
+	conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(20 * time.Millisecond)
+		causes <- req.Context().Err()
+	})
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.NoError(t, cause())
+}
+
+func TestHijack(t *testing.T) {
+	// Test: Handler takes over the connection and sees bytes sent right after the request
+	conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		require.NoError(t, w.WriteStatusLine(101))
+		w.Header().Set("Upgrade", "echo")
+		w.Header().Set("Connection", "Upgrade")
+		hijacked, rw, err := w.Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		go func() {
+			defer hijacked.Close()
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString("echo: " + line)
+			rw.Flush()
+		}()
+	})
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhel")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", line)
+	for line != "\r\n" {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = io.WriteString(conn, "lo\n")
+	require.NoError(t, err)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello\n", string(rest))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+)
+
+// VirtualHosts dispatches requests to different handlers based on the Host
+// header. Hosts are registered either by exact name ("example.com") or as a
+// wildcard matching any subdomain ("*.example.com"). Requests for an unknown
+// host go to the default handler, or get a 421 Misdirected Request if there
+// is none.
+type VirtualHosts struct {
+	hosts          map[string]Handler
+	wildcards      map[string]Handler
+	defaultHandler Handler
+
+	// ErrorPages, if set, replaces the server's error pages (see
+	// WithErrorPages) for the 421 response.
+	ErrorPages ErrorPages
+}
+
+func NewVirtualHosts(defaultHandler Handler) *VirtualHosts {
+	return &VirtualHosts{
+		hosts:          make(map[string]Handler),
+		wildcards:      make(map[string]Handler),
+		defaultHandler: defaultHandler,
+	}
+}
+
+func (v *VirtualHosts) Handle(host string, handler Handler) {
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		v.wildcards[suffix] = handler
+		return
+	}
+	v.hosts[host] = handler
+}
+
+func (v *VirtualHosts) Dispatch(w *response.Writer, req *request.Request) {
+	handler := v.match(req.Headers.Get("Host"))
+	if handler == nil {
+		hErr := &HandlerError{
+			StatusCode: 421,
+			Detail:     "no such host",
+		}
+		pages := v.ErrorPages
+		if pages == nil {
+			pages = requestErrorPages(req)
+		}
+		pages.Write(w, req, hErr)
+		return
+	}
+	handler(w, req)
+}
+
+func (v *VirtualHosts) match(host string) Handler {
+	host = strings.ToLower(stripPort(host))
+	if handler, ok := v.hosts[host]; ok {
+		return handler
+	}
+
+	// try the longest wildcard suffix first, so that "*.api.example.com"
+	// wins over "*.example.com"
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		if handler, ok := v.wildcards[host[i:]]; ok {
+			return handler
+		}
+		next := strings.IndexByte(host[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return v.defaultHandler
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
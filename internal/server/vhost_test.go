@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	var matched string
+	handlerFor := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			matched = name
+		}
+	}
+
+	vhosts := NewVirtualHosts(handlerFor("default"))
+	vhosts.Handle("example.com", handlerFor("example"))
+	vhosts.Handle("*.example.com", handlerFor("wildcard"))
+	vhosts.Handle("*.api.example.com", handlerFor("api"))
+
+	// Test: Exact match, with and without port
+	vhosts.match("example.com")(nil, nil)
+	assert.Equal(t, "example", matched)
+	vhosts.match("EXAMPLE.com:42069")(nil, nil)
+	assert.Equal(t, "example", matched)
+
+	// Test: Wildcard subdomains
+	vhosts.match("www.example.com")(nil, nil)
+	assert.Equal(t, "wildcard", matched)
+	vhosts.match("a.b.example.com")(nil, nil)
+	assert.Equal(t, "wildcard", matched)
+	vhosts.match("v1.api.example.com:8080")(nil, nil)
+	assert.Equal(t, "api", matched)
+
+	// Test: Unknown host falls back to the default
+	vhosts.match("localhost:42069")(nil, nil)
+	assert.Equal(t, "default", matched)
+	vhosts.match("notexample.com")(nil, nil)
+	assert.Equal(t, "default", matched)
+
+	// Test: No default handler
+	vhosts = NewVirtualHosts(nil)
+	assert.Nil(t, vhosts.match("localhost"))
+}
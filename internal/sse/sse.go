@@ -0,0 +1,225 @@
+// Package sse sends Server-Sent Events (text/event-stream, see the HTML
+// standard, section 9.2) as a chunked response.
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+)
+
+// DefaultHeartbeat is how often a Stream sends a comment when there are no
+// events, to keep proxies from timing out the connection and to notice
+// clients that went away.
+const DefaultHeartbeat = 15 * time.Second
+
+var (
+	ErrInvalidEvent = errors.New("invalid event")
+	ErrClosed       = errors.New("event stream closed")
+)
+
+// Event is a single event. Only Data is required.
+type Event struct {
+	// Event is the event type; empty means "message".
+	Event string
+	// ID becomes the client's last event ID, which it sends back in the
+	// Last-Event-ID header when it reconnects.
+	ID   string
+	Data string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+// Stream writes events to a response. Its methods may be called from several
+// goroutines.
+type Stream struct {
+	w           *response.Writer
+	ctx         context.Context
+	lastEventID string
+	interval    time.Duration
+
+	mu     sync.Mutex
+	ticker *time.Ticker
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type Option func(*Stream)
+
+// WithHeartbeat sets the interval between heartbeat comments. Zero turns
+// them off.
+func WithHeartbeat(d time.Duration) Option {
+	return func(s *Stream) {
+		s.interval = d
+	}
+}
+
+// NewStream starts an event stream response to req. The stream ends when the
+// request's context is cancelled, e.g. because the client disconnected, or
+// when Close is called, which has to happen before the handler returns.
+func NewStream(w *response.Writer, req *request.Request, opts ...Option) (*Stream, error) {
+	s := &Stream{
+		w:           w,
+		ctx:         req.Context(),
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+		interval:    DefaultHeartbeat,
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := w.WriteStatusLine(200)
+	if err != nil {
+		return nil, err
+	}
+	h := response.GetDefaultHeaders(0, "text/event-stream")
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Cache-Control", "no-cache")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.interval > 0 {
+		s.ticker = time.NewTicker(s.interval)
+		s.wg.Add(1)
+		go s.heartbeat()
+	}
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event the client received before
+// it reconnected, or "" if it is a new client.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client has gone away or the server is shutting
+// down, after which Send fails.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+func (s *Stream) heartbeat() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.ticker.C:
+			err := s.Comment("heartbeat")
+			if err != nil {
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Send writes the event and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	data, err := formatEvent(e)
+	if err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+// Comment sends a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("%w: comment contains a line break", ErrInvalidEvent)
+	}
+	return s.write([]byte(":" + text + "\n\n"))
+}
+
+func (s *Stream) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.ctx.Err() != nil {
+		return context.Cause(s.ctx)
+	}
+	_, err := s.w.WriteChunkedBody(data)
+	if err != nil {
+		return err
+	}
+	err = s.w.Flush()
+	if err != nil {
+		return err
+	}
+	if s.ticker != nil {
+		s.ticker.Reset(s.interval)
+	}
+	return nil
+}
+
+// Close stops the heartbeat and ends the response. The client will
+// reconnect unless it is told otherwise, e.g. with a 204 on its next
+// request.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	_, err := s.w.WriteChunkedBodyDone()
+	if err != nil {
+		return err
+	}
+	return s.w.WriteTrailers(response.GetNewHeaders())
+}
+
+// formatEvent encodes e in the event stream format. Data with line breaks is
+// split over several data fields, which the client joins again with "\n".
+func formatEvent(e Event) ([]byte, error) {
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return nil, fmt.Errorf("%w: event type contains a line break", ErrInvalidEvent)
+	}
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return nil, fmt.Errorf("%w: ID contains a line break or NUL", ErrInvalidEvent)
+	}
+
+	var b strings.Builder
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
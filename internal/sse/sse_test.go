@@ -0,0 +1,134 @@
+package sse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, headers string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost\r\n" + headers + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// body returns the decoded body of the chunked response in buf.
+func body(t *testing.T, buf *bytes.Buffer) string {
+	t.Helper()
+	head, chunked, ok := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, ok)
+	head += "\r\n"
+	assert.Contains(t, head, "content-type: text/event-stream\r\n")
+	assert.Contains(t, head, "cache-control: no-cache\r\n")
+	data, err := io.ReadAll(httputil.NewChunkedReader(strings.NewReader(chunked)))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestFormatEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{"Data only", Event{Data: "hello"}, "data: hello\n\n"},
+		{"All fields", Event{Event: "update", ID: "42", Data: "x", Retry: 3 * time.Second}, "event: update\nid: 42\nretry: 3000\ndata: x\n\n"},
+		{"Multi-line data", Event{Data: "a\nb\r\nc\rd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{"Empty data", Event{Event: "ping"}, "event: ping\ndata: \n\n"},
+	} {
+		got, err := formatEvent(tc.event)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.want, string(got), tc.name)
+	}
+
+	// Test: Line breaks in single-line fields
+	_, err := formatEvent(Event{Event: "a\nb"})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+	_, err = formatEvent(Event{ID: "1\r2"})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+}
+
+func TestStream(t *testing.T) {
+	// Test: Events are sent as chunks and the stream ends on Close
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	s, err := NewStream(w, newRequest(t, "Last-Event-ID: 7\r\n"), WithHeartbeat(0))
+	require.NoError(t, err)
+	assert.Equal(t, "7", s.LastEventID())
+	require.NoError(t, s.Send(Event{ID: "8", Data: "first"}))
+	assert.True(t, strings.HasSuffix(buf.String(), "data: first\n\n\r\n"), "events are flushed right away")
+	require.NoError(t, s.Comment("note"))
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "id: 8\ndata: first\n\n:note\n\n", body(t, &buf))
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+
+	// Test: No Last-Event-ID from a new client
+	buf.Reset()
+	s, err = NewStream(response.NewWriter(&buf), newRequest(t, ""), WithHeartbeat(0))
+	require.NoError(t, err)
+	assert.Equal(t, "", s.LastEventID())
+	require.NoError(t, s.Close())
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	// Test: Comments are sent while there are no events
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	heartbeats := make(chan struct{})
+	go func() {
+		var received bytes.Buffer
+		buf := make([]byte, 512)
+		for {
+			n, err := pr.Read(buf)
+			received.Write(buf[:n])
+			if bytes.Count(received.Bytes(), []byte(":heartbeat\n\n")) >= 2 {
+				close(heartbeats)
+				// keep the writer from blocking until the stream is closed
+				io.Copy(io.Discard, pr)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	w := response.NewWriter(pw)
+	s, err := NewStream(w, newRequest(t, ""), WithHeartbeat(10*time.Millisecond))
+	require.NoError(t, err)
+	select {
+	case <-heartbeats:
+	case <-time.After(time.Second):
+		t.Fatal("fewer than two heartbeats arrived")
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, w.Finish())
+	require.NoError(t, pw.Close())
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	// Test: Sending fails with the cause once the context is cancelled
+	errGone := errors.New("client gone")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	req := newRequest(t, "").WithContext(ctx)
+	var buf bytes.Buffer
+	s, err := NewStream(response.NewWriter(&buf), req, WithHeartbeat(5*time.Millisecond))
+	require.NoError(t, err)
+	cancel(errGone)
+	<-s.Done()
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), errGone)
+	require.NoError(t, s.Close())
+	assert.NotContains(t, buf.String(), "late")
+}
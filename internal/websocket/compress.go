@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// deflateResponse accepts permessage-deflate without context takeover in
+// either direction, so that each message can be (de)compressed on its own
+// (RFC 7692, section 7.1.1).
+const deflateResponse = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// deflateFlushTail ends the output of a flush. Senders strip it from each
+// message and receivers put it back (RFC 7692, section 7.2.1).
+const deflateFlushTail = "\x00\x00\xff\xff"
+
+// negotiateDeflate reports whether one of the offers in a
+// Sec-WebSocket-Extensions header is a permessage-deflate one that
+// deflateResponse accepts.
+func negotiateDeflate(extensions string) bool {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+			continue
+		}
+		if acceptableDeflateParams(params[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptableDeflateParams(params []string) bool {
+	seen := make(map[string]bool)
+	for _, param := range params {
+		name, value, hasValue := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if hasValue {
+				return false
+			}
+		case "client_max_window_bits":
+			// the client may use a smaller window than it offers, which
+			// the decompressor handles
+		case "server_max_window_bits":
+			// the compressor always uses the full window
+			if value != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// deflateWriter compresses a single message.
+type deflateWriter struct {
+	flate *flate.Writer
+}
+
+func newDeflateWriter(w io.Writer) *deflateWriter {
+	fw := flateWriterPool.Get().(*flate.Writer)
+	fw.Reset(w)
+	return &deflateWriter{flate: fw}
+}
+
+func (d *deflateWriter) Write(p []byte) (int, error) {
+	return d.flate.Write(p)
+}
+
+// finish flushes the compressed message, which then ends with
+// deflateFlushTail, and returns the compressor to the pool.
+func (d *deflateWriter) finish() error {
+	err := d.flate.Flush()
+	d.flate.Reset(nil)
+	flateWriterPool.Put(d.flate)
+	return err
+}
+
+func trimFlushTail(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte(deflateFlushTail)) {
+		return b[:len(b)-len(deflateFlushTail)]
+	}
+	return b
+}
+
+// decompress undoes permessage-deflate for a message. Appending an empty
+// final block after the flush tail lets the decompressor end cleanly.
+func decompress(data []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(
+		bytes.NewReader(data),
+		strings.NewReader(deflateFlushTail+"\x01\x00\x00\xff\xff"),
+	))
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message: %w", err)
+	}
+	if len(out) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrMessageTooLarge, maxSize)
+	}
+	return out, nil
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xA
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+const maxControlPayload = 125
+
+type CloseCode int
+
+const (
+	CloseNormal          CloseCode = 1000
+	CloseGoingAway       CloseCode = 1001
+	CloseProtocolError   CloseCode = 1002
+	CloseUnsupportedData CloseCode = 1003
+	CloseNoStatus        CloseCode = 1005
+	CloseInvalidPayload  CloseCode = 1007
+	ClosePolicyViolation CloseCode = 1008
+	CloseMessageTooBig   CloseCode = 1009
+	CloseInternalError   CloseCode = 1011
+)
+
+// validCloseCode reports whether code may be sent in a close frame (RFC
+// 6455, section 7.4).
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode opcode
+	length int64
+	mask   [4]byte
+}
+
+// readFrameHeader reads and validates the header of the next frame. Frames
+// from clients have to be masked.
+func (c *Conn) readFrameHeader() (frameHeader, error) {
+	var h frameHeader
+	var b [8]byte
+	_, err := io.ReadFull(c.rw, b[:2])
+	if err != nil {
+		return h, fmt.Errorf("error reading frame: %w", err)
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.opcode = opcode(b[0] & 0x0F)
+	masked := b[1]&0x80 != 0
+	h.length = int64(b[1] & 0x7F)
+
+	switch {
+	case b[0]&0x30 != 0:
+		return h, c.fail(CloseProtocolError, fmt.Errorf("%w: reserved bits set", ErrProtocol))
+	case h.rsv1 && (!c.compress || h.opcode == opContinuation || h.opcode.isControl()):
+		return h, c.fail(CloseProtocolError, fmt.Errorf("%w: unexpected RSV1 bit", ErrProtocol))
+	case h.opcode > opBinary && h.opcode < opClose || h.opcode > opPong:
+		return h, c.fail(CloseProtocolError, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, h.opcode))
+	case h.opcode.isControl() && (!h.fin || h.length > maxControlPayload):
+		return h, c.fail(CloseProtocolError, fmt.Errorf("%w: fragmented or oversized control frame", ErrProtocol))
+	case !masked:
+		return h, c.fail(CloseProtocolError, fmt.Errorf("%w: unmasked frame", ErrProtocol))
+	}
+
+	switch h.length {
+	case 126:
+		_, err = io.ReadFull(c.rw, b[:2])
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		_, err = io.ReadFull(c.rw, b[:8])
+		length := binary.BigEndian.Uint64(b[:8])
+		if length>>63 != 0 {
+			return h, c.fail(CloseProtocolError, fmt.Errorf("%w: invalid payload length", ErrProtocol))
+		}
+		h.length = int64(length)
+	}
+	if err != nil {
+		return h, fmt.Errorf("error reading frame: %w", err)
+	}
+	_, err = io.ReadFull(c.rw, h.mask[:])
+	if err != nil {
+		return h, fmt.Errorf("error reading frame: %w", err)
+	}
+	return h, nil
+}
+
+// readPayload reads the payload of the frame h is the header of and unmasks
+// it.
+func (c *Conn) readPayload(h frameHeader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	_, err := io.ReadFull(c.rw, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error reading frame: %w", err)
+	}
+	maskBytes(payload, h.mask)
+	return payload, nil
+}
+
+func maskBytes(b []byte, mask [4]byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// writeFrame sends a single unmasked frame, as servers do. writeMu must be
+// held.
+func (c *Conn) writeFrame(fin, rsv1 bool, op opcode, payload []byte) error {
+	if c.closeSent {
+		return ErrClosed
+	}
+	var header [10]byte
+	if fin {
+		header[0] |= 0x80
+	}
+	if rsv1 {
+		header[0] |= 0x40
+	}
+	header[0] |= byte(op)
+	n := 2
+	switch {
+	case len(payload) <= 125:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+		n += 8
+	}
+	_, err := c.rw.Write(header[:n])
+	if err != nil {
+		return err
+	}
+	_, err = c.rw.Write(payload)
+	if err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *Conn) writeControl(op opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrame(true, false, op, payload)
+}
+
+// writeClose sends a close frame unless one has been sent already. Nothing
+// can be written after it.
+func (c *Conn) writeClose(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	err := c.writeFrame(true, false, opClose, payload)
+	c.closeSent = true
+	return err
+}
+
+func closePayload(code CloseCode, reason string) []byte {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+// parseClosePayload returns the status code and reason of a close frame. A
+// frame without a status code gives CloseNoStatus.
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	if len(payload) == 0 {
+		return &CloseError{Code: CloseNoStatus}, nil
+	}
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("%w: truncated close frame", ErrProtocol)
+	}
+	code := CloseCode(binary.BigEndian.Uint16(payload))
+	if !validCloseCode(code) {
+		return nil, fmt.Errorf("%w: invalid close code %d", ErrProtocol, code)
+	}
+	if !utf8.Valid(payload[2:]) {
+		return nil, ErrInvalidUTF8
+	}
+	return &CloseError{Code: code, Reason: string(payload[2:])}, nil
+}
+
+// maxFrameSize is the size at which a MessageWriter sends a fragment.
+const maxFrameSize = 4096
+
+// MessageWriter writes a message in fragments, see Conn.NextWriter.
+type MessageWriter struct {
+	c       *Conn
+	opcode  opcode
+	buf     []byte
+	deflate *deflateWriter
+	closed  bool
+}
+
+func newMessageWriter(c *Conn, op opcode) *MessageWriter {
+	mw := &MessageWriter{c: c, opcode: op}
+	if c.compress {
+		mw.deflate = newDeflateWriter(frameSink{mw})
+	}
+	return mw
+}
+
+func (mw *MessageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, ErrClosed
+	}
+	if mw.deflate != nil {
+		return mw.deflate.Write(p)
+	}
+	return mw.write(p)
+}
+
+// write buffers (compressed) message data and sends full fragments. The
+// last bytes of compressed data are held back, since Close has to strip
+// them from the final fragment.
+func (mw *MessageWriter) write(p []byte) (int, error) {
+	mw.buf = append(mw.buf, p...)
+	holdBack := 0
+	if mw.deflate != nil {
+		holdBack = len(deflateFlushTail)
+	}
+	for len(mw.buf)-holdBack > maxFrameSize {
+		err := mw.writeFragment(false, mw.buf[:maxFrameSize])
+		if err != nil {
+			return 0, err
+		}
+		mw.buf = append(mw.buf[:0], mw.buf[maxFrameSize:]...)
+	}
+	return len(p), nil
+}
+
+func (mw *MessageWriter) writeFragment(fin bool, payload []byte) error {
+	op := mw.opcode
+	rsv1 := mw.deflate != nil && op != opContinuation
+	mw.opcode = opContinuation
+	mw.c.writeMu.Lock()
+	defer mw.c.writeMu.Unlock()
+	return mw.c.writeFrame(fin, rsv1, op, payload)
+}
+
+// Close sends the rest of the message as the final fragment.
+func (mw *MessageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+	defer mw.c.messageMu.Unlock()
+	if mw.deflate != nil {
+		err := mw.deflate.finish()
+		if err != nil {
+			return err
+		}
+		mw.buf = trimFlushTail(mw.buf)
+	}
+	return mw.writeFragment(true, mw.buf)
+}
+
+// frameSink is where a deflateWriter puts its output.
+type frameSink struct {
+	mw *MessageWriter
+}
+
+func (s frameSink) Write(p []byte) (int, error) {
+	return s.mw.write(p)
+}
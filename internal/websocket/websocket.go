@@ -0,0 +1,438 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455) on top of the server package, including the permessage-deflate
+// extension (RFC 7692).
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/roerd/httpfromtcp/internal/headers"
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/roerd/httpfromtcp/internal/server"
+)
+
+// DefaultMaxMessageSize is the largest message a Conn accepts unless
+// WithMaxMessageSize says otherwise, in bytes after decompression.
+const DefaultMaxMessageSize = 1 << 20
+
+// closeTimeout is how long Close waits for the client to answer the close
+// handshake before closing the connection anyway.
+const closeTimeout = 5 * time.Second
+
+// acceptGUID is appended to Sec-WebSocket-Key to compute
+// Sec-WebSocket-Accept (RFC 6455, section 4.2.2).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrProtocol        = errors.New("websocket protocol error")
+	ErrInvalidUTF8     = errors.New("invalid UTF-8 in text message")
+	ErrMessageTooLarge = errors.New("websocket message too large")
+	ErrClosed          = errors.New("websocket connection closed")
+)
+
+// CloseError is returned by ReadMessage once the client has closed the
+// connection, with the status code and reason it gave.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed: %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+// Conn is a WebSocket connection. One goroutine may read messages while
+// others write them; writes are serialised.
+type Conn struct {
+	conn        net.Conn
+	rw          *bufio.ReadWriter
+	subprotocol string
+	compress    bool
+
+	maxMessageSize int
+	subprotocols   []string
+	allowCompress  bool
+	checkOrigin    func(req *request.Request) bool
+
+	readErr error
+
+	// messageMu is held for the whole of a data message, writeMu for each
+	// frame, so that control frames can go between the fragments of a
+	// message.
+	messageMu  sync.Mutex
+	writeMu    sync.Mutex
+	closeSent  bool
+	closeTimer *time.Timer
+}
+
+type Option func(*Conn)
+
+// WithSubprotocols lists the subprotocols the server speaks, in order of
+// preference. The first one the client offers is picked, see Subprotocol.
+func WithSubprotocols(protocols ...string) Option {
+	return func(c *Conn) {
+		c.subprotocols = protocols
+	}
+}
+
+// WithCompression accepts the permessage-deflate extension if the client
+// offers it. Every message is then compressed on its own, without sharing
+// a dictionary with earlier ones.
+func WithCompression() Option {
+	return func(c *Conn) {
+		c.allowCompress = true
+	}
+}
+
+// WithMaxMessageSize sets the largest message ReadMessage accepts, in bytes
+// after decompression. Larger ones close the connection with 1009.
+func WithMaxMessageSize(n int) Option {
+	return func(c *Conn) {
+		c.maxMessageSize = n
+	}
+}
+
+// WithOriginCheck replaces the check of the Origin header. By default
+// browsers may only connect from pages on the same host, to keep other
+// sites from using their users' cookies.
+func WithOriginCheck(check func(req *request.Request) bool) Option {
+	return func(c *Conn) {
+		c.checkOrigin = check
+	}
+}
+
+// Upgrade performs the opening handshake and takes over the connection. If
+// the request is not a valid WebSocket handshake, it responds with an error
+// and returns it as a *server.HandlerError.
+//
+// The request's context is cancelled when the handler returns, so handlers
+// should use the Conn before returning.
+func Upgrade(w *response.Writer, req *request.Request, opts ...Option) (*Conn, error) {
+	c := &Conn{
+		maxMessageSize: DefaultMaxMessageSize,
+		checkOrigin:    sameOrigin,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	herr := c.checkHandshake(req)
+	if herr != nil {
+		herr.WriteResponse(w, req)
+		return nil, herr
+	}
+
+	err := w.WriteStatusLine(101)
+	if err != nil {
+		return nil, err
+	}
+	h := w.Header()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(req.Headers.Get("Sec-WebSocket-Key")))
+	c.subprotocol = negotiateSubprotocol(req.Headers.Get("Sec-WebSocket-Protocol"), c.subprotocols)
+	if c.subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", c.subprotocol)
+	}
+	if c.allowCompress {
+		c.compress = negotiateDeflate(req.Headers.Get("Sec-WebSocket-Extensions"))
+		if c.compress {
+			h.Set("Sec-WebSocket-Extensions", deflateResponse)
+		}
+	}
+
+	c.conn, c.rw, err = w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkHandshake validates the client's opening handshake (RFC 6455,
+// section 4.2.1).
+func (c *Conn) checkHandshake(req *request.Request) *server.HandlerError {
+	if req.RequestLine.Method != request.MethodGet {
+		allow := headers.NewHeaders()
+		allow.Set("Allow", request.MethodGet)
+		return &server.HandlerError{StatusCode: 405, Detail: "websocket handshake must use GET", Header: allow}
+	}
+	if !req.RequestLine.ProtoAtLeast(1, 1) {
+		return &server.HandlerError{StatusCode: 400, Detail: "websocket handshake requires HTTP/1.1"}
+	}
+	if !hasToken(req.Headers.Get("Upgrade"), "websocket") || !hasToken(req.Headers.Get("Connection"), "upgrade") {
+		return &server.HandlerError{StatusCode: 400, Detail: "not a websocket handshake"}
+	}
+	if req.Headers.Get("Sec-WebSocket-Version") != "13" {
+		version := headers.NewHeaders()
+		version.Set("Sec-WebSocket-Version", "13")
+		return &server.HandlerError{StatusCode: 426, Detail: "unsupported websocket version", Header: version}
+	}
+	key, err := base64.StdEncoding.DecodeString(req.Headers.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return &server.HandlerError{StatusCode: 400, Detail: "invalid Sec-WebSocket-Key"}
+	}
+	if !c.checkOrigin(req) {
+		return &server.HandlerError{StatusCode: 403, Detail: "origin not allowed"}
+	}
+	return nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// sameOrigin accepts requests without an Origin header, i.e. not from a
+// browser, and ones whose Origin has the same host as the request.
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers.Get("Host"))
+}
+
+// hasToken reports whether the comma-separated list value contains token,
+// ignoring case.
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateSubprotocol picks the first of supported the client offers, or
+// "" if there is none.
+func negotiateSubprotocol(offered string, supported []string) string {
+	for _, protocol := range supported {
+		if hasToken(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// Subprotocol returns the subprotocol picked during the handshake, or "" if
+// none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn returns the underlying connection, e.g. to set deadlines.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ReadMessage returns the next data message, answering pings and the close
+// handshake along the way. Once the client has closed the connection it
+// returns a *CloseError, and after a protocol violation, which closes the
+// connection with the matching status code, an error wrapping ErrProtocol,
+// ErrInvalidUTF8 or ErrMessageTooLarge. Any other error, e.g. the client
+// dropping the connection without a close frame, closes the connection as
+// well. Every call after an error returns the same error.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	messageType, data, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		// the connection is no use without reading, and nothing else
+		// closes it once the server has handed it over
+		c.closeConn()
+	}
+	return messageType, data, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var (
+		messageType MessageType
+		compressed  bool
+		data        []byte
+	)
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+		if !h.opcode.isControl() && int64(len(data))+h.length > int64(c.maxMessageSize) {
+			return 0, nil, c.fail(CloseMessageTooBig, fmt.Errorf("%w: more than %d bytes", ErrMessageTooLarge, c.maxMessageSize))
+		}
+		payload, err := c.readPayload(h)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch h.opcode {
+		case opPing:
+			err = c.writeControl(opPong, payload)
+			if err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opText, opBinary:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: new message before the previous one ended", ErrProtocol))
+			}
+			messageType, compressed = MessageType(h.opcode), h.rsv1
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: continuation frame without a message", ErrProtocol))
+			}
+		}
+		data = append(data, payload...)
+		if h.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		data, err = decompress(data, c.maxMessageSize)
+		if errors.Is(err, ErrMessageTooLarge) {
+			return 0, nil, c.fail(CloseMessageTooBig, err)
+		}
+		if err != nil {
+			return 0, nil, c.fail(CloseInvalidPayload, err)
+		}
+	}
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return 0, nil, c.fail(CloseInvalidPayload, ErrInvalidUTF8)
+	}
+	return messageType, data, nil
+}
+
+// handleClose answers the client's close frame, unless it is the answer to
+// ours, and closes the connection.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr, err := parseClosePayload(payload)
+	if err != nil {
+		code := CloseProtocolError
+		if errors.Is(err, ErrInvalidUTF8) {
+			code = CloseInvalidPayload
+		}
+		return c.fail(code, err)
+	}
+	var echo []byte
+	if closeErr.Code != CloseNoStatus {
+		echo = closePayload(closeErr.Code, "")
+	}
+	c.writeClose(echo)
+	c.closeConn()
+	return closeErr
+}
+
+// fail closes the connection with code after the client violated the
+// protocol, and returns err.
+func (c *Conn) fail(code CloseCode, err error) error {
+	c.writeClose(closePayload(code, err.Error()))
+	c.closeConn()
+	return err
+}
+
+func (c *Conn) closeConn() error {
+	c.writeMu.Lock()
+	if c.closeTimer != nil {
+		c.closeTimer.Stop()
+	}
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+// WriteMessage sends data as a single message.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	w, err := c.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// NextWriter starts a message whose content is written to the returned
+// writer, which sends it in fragments as it fills up. The message ends when
+// the writer is closed; until then other messages have to wait.
+func (c *Conn) NextWriter(messageType MessageType) (*MessageWriter, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, fmt.Errorf("invalid message type %d", messageType)
+	}
+	c.messageMu.Lock()
+	return newMessageWriter(c, opcode(messageType)), nil
+}
+
+// Ping sends a ping with data, which may be at most 125 bytes. The client
+// answers with a pong, which ReadMessage consumes.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("ping payload longer than %d bytes", maxControlPayload)
+	}
+	return c.writeControl(opPing, data)
+}
+
+// CloseNow closes the connection right away, without a closing handshake,
+// e.g. when the handler gives up on a client that stopped responding. It
+// may be called after Close or more than once.
+func (c *Conn) CloseNow() error {
+	c.writeMu.Lock()
+	c.closeSent = true
+	c.writeMu.Unlock()
+	err := c.closeConn()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close starts the closing handshake with code and reason. The connection
+// is closed when the client answers, which a concurrent ReadMessage
+// notices, or after a few seconds at the latest.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		return fmt.Errorf("close reason longer than %d bytes", maxControlPayload-2)
+	}
+	err := c.writeClose(closePayload(code, reason))
+	c.writeMu.Lock()
+	if c.closeTimer == nil {
+		c.closeTimer = time.AfterFunc(closeTimeout, func() { c.conn.Close() })
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,375 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/roerd/httpfromtcp/internal/request"
+	"github.com/roerd/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+// upgrade performs the handshake over a pipe and returns the server's Conn
+// along with the client's end and the response head.
+func upgrade(t *testing.T, extraHeaders string, opts ...Option) (*Conn, net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(handshake + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { serverConn.Close(); clientConn.Close() })
+	w := response.NewWriter(serverConn)
+	w.EnableHijack(func() (net.Conn, *bufio.Reader, error) {
+		return serverConn, bufio.NewReader(serverConn), nil
+	})
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		c, err := Upgrade(w, req, opts...)
+		done <- result{c, err}
+	}()
+	reader := bufio.NewReader(clientConn)
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	res := <-done
+	require.NoError(t, res.err)
+	return res.conn, clientConn, reader, head.String()
+}
+
+// writeClientFrame sends a masked frame whose first header byte is b0.
+func writeClientFrame(t *testing.T, conn net.Conn, b0 byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	frame := []byte{b0}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(len(payload)))
+	}
+	frame = append(frame, mask[:]...)
+	masked := bytes.Clone(payload)
+	maskBytes(masked, mask)
+	_, err := conn.Write(append(frame, masked...))
+	require.NoError(t, err)
+}
+
+// readServerFrame reads an unmasked frame and returns its first header byte
+// and payload.
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var b [8]byte
+	_, err := io.ReadFull(reader, b[:2])
+	require.NoError(t, err)
+	require.Zero(t, b[1]&0x80, "server frames are not masked")
+	b0, length := b[0], uint64(b[1]&0x7F)
+	switch length {
+	case 126:
+		_, err = io.ReadFull(reader, b[:2])
+		length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		_, err = io.ReadFull(reader, b[:8])
+		length = binary.BigEndian.Uint64(b[:8])
+	}
+	require.NoError(t, err)
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	require.NoError(t, err)
+	return b0, payload
+}
+
+// echo sends back every message c receives and reports the error that ends
+// the loop.
+func echo(c *Conn) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := c.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			err = c.WriteMessage(messageType, data)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455, section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgrade(t *testing.T) {
+	// Test: Successful handshake with a subprotocol
+	c, _, _, head := upgrade(t, "Sec-WebSocket-Protocol: soap, chat\r\n", WithSubprotocols("chat", "soap"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "upgrade: websocket\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+	assert.Equal(t, "chat", c.Subprotocol())
+
+	// Test: No common subprotocol
+	c, _, _, head = upgrade(t, "Sec-WebSocket-Protocol: mqtt\r\n", WithSubprotocols("chat"))
+	assert.NotContains(t, head, "sec-websocket-protocol")
+	assert.Equal(t, "", c.Subprotocol())
+
+	// Test: Same origin is allowed by default
+	_, _, _, head = upgrade(t, "Origin: https://example.com\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request string
+		status  string
+		header  string
+	}{
+		{"Not GET", strings.Replace(handshake, "GET", "POST", 1), "405 Method Not Allowed", "allow: GET\r\n"},
+		{"No Upgrade header", strings.Replace(handshake, "Upgrade: websocket\r\n", "", 1), "400 Bad Request", ""},
+		{"Wrong version", strings.Replace(handshake, "Version: 13", "Version: 8", 1), "426 Upgrade Required", "sec-websocket-version: 13\r\n"},
+		{"Invalid key", strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1), "400 Bad Request", ""},
+		{"Cross origin", handshake + "Origin: https://evil.example\r\n", "403 Forbidden", ""},
+	} {
+		req, err := request.RequestFromReader(strings.NewReader(tc.request + "\r\n"))
+		require.NoError(t, err, tc.name)
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		_, err = Upgrade(w, req)
+		assert.Error(t, err, tc.name)
+		require.NoError(t, w.Finish(), tc.name)
+		assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 "+tc.status+"\r\n"), "%s: %q", tc.name, buf.String())
+		assert.Contains(t, buf.String(), tc.header, tc.name)
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	for _, tc := range []struct {
+		offer string
+		ok    bool
+	}{
+		{"permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", true},
+		{"permessage-deflate; client_max_window_bits=10; server_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10", false},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", true},
+		{"permessage-deflate; x-unknown", false},
+		{"x-webkit-deflate-frame", false},
+		{"", false},
+	} {
+		assert.Equal(t, tc.ok, negotiateDeflate(tc.offer), tc.offer)
+	}
+}
+
+func TestConn(t *testing.T) {
+	c, client, reader, _ := upgrade(t, "")
+	errs := echo(c)
+
+	// Test: Text message
+	writeClientFrame(t, client, 0x81, []byte("Hello"))
+	b0, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0x81), b0)
+	assert.Equal(t, "Hello", string(payload))
+
+	// Test: Fragmented binary message with a ping in between
+	writeClientFrame(t, client, 0x02, []byte{1, 2})
+	writeClientFrame(t, client, 0x89, []byte("ping"))
+	b0, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x8A), b0)
+	assert.Equal(t, "ping", string(payload))
+	writeClientFrame(t, client, 0x80, []byte{3})
+	b0, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x82), b0)
+	assert.Equal(t, []byte{1, 2, 3}, payload)
+
+	// Test: Text split inside a multi-byte character
+	writeClientFrame(t, client, 0x01, []byte("caf\xc3"))
+	writeClientFrame(t, client, 0x80, []byte("\xa9"))
+	_, payload = readServerFrame(t, reader)
+	assert.Equal(t, "café", string(payload))
+
+	// Test: Close handshake started by the client
+	writeClientFrame(t, client, 0x88, closePayload(CloseGoingAway, "bye"))
+	b0, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, closePayload(CloseGoingAway, ""), payload)
+	err := <-errs
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+	_, _, err = c.ReadMessage()
+	assert.Equal(t, closeErr, err)
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnClose(t *testing.T) {
+	// Test: Close handshake started by the server
+	c, client, reader, _ := upgrade(t, "")
+	errs := echo(c)
+	go c.Close(CloseNormal, "done")
+	b0, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, closePayload(CloseNormal, "done"), payload)
+	writeClientFrame(t, client, 0x88, closePayload(CloseNormal, ""))
+	var closeErr *CloseError
+	require.ErrorAs(t, <-errs, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Client drops the connection without a close frame
+	c, client, _, _ = upgrade(t, "")
+	errs = echo(c)
+	client.Close()
+	require.Error(t, <-errs)
+	_, err = c.conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// Test: CloseNow skips the handshake
+	c, _, reader, _ = upgrade(t, "")
+	require.NoError(t, c.CloseNow())
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NoError(t, c.CloseNow())
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		b0      byte
+		payload []byte
+		code    CloseCode
+		err     error
+	}{
+		{"Invalid UTF-8", 0x81, []byte("\xff\xfe"), CloseInvalidPayload, ErrInvalidUTF8},
+		{"Too large", 0x82, make([]byte, 200), CloseMessageTooBig, ErrMessageTooLarge},
+		{"Unknown opcode", 0x83, nil, CloseProtocolError, ErrProtocol},
+		{"Reserved bits", 0xC1, []byte("hi"), CloseProtocolError, ErrProtocol},
+		{"Continuation without message", 0x80, []byte("hi"), CloseProtocolError, ErrProtocol},
+		{"Fragmented control frame", 0x09, nil, CloseProtocolError, ErrProtocol},
+		{"Invalid close code", 0x88, closePayload(1004, ""), CloseProtocolError, ErrProtocol},
+	} {
+		c, client, reader, _ := upgrade(t, "", WithMaxMessageSize(100))
+		errs := echo(c)
+		writeClientFrame(t, client, tc.b0, tc.payload)
+		b0, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(0x88), b0, tc.name)
+		require.GreaterOrEqual(t, len(payload), 2, tc.name)
+		assert.Equal(t, tc.code, CloseCode(binary.BigEndian.Uint16(payload)), tc.name)
+		assert.ErrorIs(t, <-errs, tc.err, tc.name)
+	}
+
+	// Test: Unmasked frame
+	c, client, reader, _ := upgrade(t, "")
+	errs := echo(c)
+	_, err := client.Write([]byte{0x81, 0x02, 'h', 'i'})
+	require.NoError(t, err)
+	b0, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, CloseProtocolError, CloseCode(binary.BigEndian.Uint16(payload)))
+	assert.ErrorIs(t, <-errs, ErrProtocol)
+}
+
+func TestConnCompression(t *testing.T) {
+	compress := func(data []byte) []byte {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		fw.Write(data)
+		fw.Flush()
+		return trimFlushTail(buf.Bytes())
+	}
+	message := strings.Repeat("compress me ", 1000)
+
+	// Test: Negotiated extension compresses both ways
+	c, client, reader, head := upgrade(t, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n", WithCompression())
+	assert.Contains(t, head, "sec-websocket-extensions: "+deflateResponse+"\r\n")
+	errs := echo(c)
+	writeClientFrame(t, client, 0xC1, compress([]byte(message)))
+	b0, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0xC1), b0)
+	assert.Less(t, len(payload), len(message))
+	data, err := decompress(payload, DefaultMaxMessageSize)
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+
+	// Test: Uncompressed messages are still accepted
+	writeClientFrame(t, client, 0x81, []byte("plain"))
+	_, payload = readServerFrame(t, reader)
+	data, err = decompress(payload, DefaultMaxMessageSize)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(data))
+
+	// Test: Size limit applies after decompression
+	c, client, reader, _ = upgrade(t, "Sec-WebSocket-Extensions: permessage-deflate\r\n", WithCompression(), WithMaxMessageSize(1000))
+	errs = echo(c)
+	writeClientFrame(t, client, 0xC1, compress([]byte(message)))
+	_, payload = readServerFrame(t, reader)
+	assert.Equal(t, CloseMessageTooBig, CloseCode(binary.BigEndian.Uint16(payload)))
+	assert.ErrorIs(t, <-errs, ErrMessageTooLarge)
+
+	// Test: Not used unless enabled
+	_, _, _, head = upgrade(t, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+}
+
+func TestNextWriter(t *testing.T) {
+	// Test: Long messages are sent in fragments
+	c, _, reader, _ := upgrade(t, "")
+	message := bytes.Repeat([]byte("x"), 2*maxFrameSize+10)
+	go func() {
+		w, err := c.NextWriter(BinaryMessage)
+		if err != nil {
+			return
+		}
+		w.Write(message[:maxFrameSize+5])
+		w.Write(message[maxFrameSize+5:])
+		w.Close()
+	}()
+	var b0s []byte
+	var data []byte
+	for {
+		b0, payload := readServerFrame(t, reader)
+		b0s = append(b0s, b0)
+		data = append(data, payload...)
+		if b0&0x80 != 0 {
+			break
+		}
+	}
+	assert.Equal(t, []byte{0x02, 0x00, 0x80}, b0s)
+	assert.Equal(t, message, data)
+}